@@ -0,0 +1,49 @@
+package client
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+var DefaultBackoff = Backoff{
+	Min:    time.Millisecond * 500,
+	Max:    time.Second * 30,
+	Factor: 2,
+	Jitter: 0.2,
+}
+
+//指数退避
+type Backoff struct {
+	//第一次重连的等待时间
+	Min time.Duration
+	//最大等待时间
+	Max time.Duration
+	//每次重连等待时间的增长倍数
+	Factor float64
+	//随机抖动比例，0.2表示在 [0.8, 1.2] 倍之间随机
+	Jitter float64
+}
+
+//第attempt次(从1开始)重连前的等待时间
+func (b Backoff) Duration(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	factor := b.Factor
+	if factor < 1 {
+		factor = 1
+	}
+
+	d := float64(b.Min) * math.Pow(factor, float64(attempt-1))
+	if b.Max > 0 && d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+
+	if b.Jitter > 0 {
+		d = d * (1 + b.Jitter*(rand.Float64()*2-1))
+	}
+
+	return time.Duration(d)
+}
@@ -0,0 +1,360 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	logger "github.com/kuhufu/cm/logger"
+	"github.com/kuhufu/cm/protocol"
+	"github.com/kuhufu/cm/protocol/Interface"
+	"github.com/kuhufu/cm/protocol/binary"
+	"github.com/kuhufu/cm/protocol/consts"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrClosed          = errors.New("client closed")
+	ErrUnexpectedReply = errors.New("unexpected reply")
+	ErrSubscribe       = errors.New("subscribe failed") //旧版本服务端回复的订阅失败，新版本返回 *Error
+)
+
+//服务端回复的带状态码的错误，用 errors.As 取得状态码
+type Error = protocol.Error
+
+//服务端发送 CmdClose 关闭了连接，Reason 为body，服务端开启 SendCloseReason 时为关闭原因
+//errors.Is(err, ErrClosed) 为true
+type CloseError struct {
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return ErrClosed.Error() + ": " + e.Reason
+}
+
+func (e *CloseError) Unwrap() error {
+	return ErrClosed
+}
+
+type reply struct {
+	body []byte
+	err  error
+}
+
+type Client struct {
+	conn      net.Conn
+	opts      Options
+	requestId uint32
+	authReply []byte
+
+	mu      sync.Mutex
+	pending map[uint32]chan reply //等待回复的请求，按RequestId匹配
+
+	wL        sync.Mutex //写锁，保证一条消息完整写入
+	pushC     chan []byte
+	seqs      *seqWindow
+	exitC     chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+//连接addr并完成认证，authData 原样作为 CmdAuth 消息的body
+//认证失败时返回 *Error，状态码为 consts.CodeUnauthorized 或认证拦截器返回的状态码
+func Dial(addr string, authData []byte, opts ...Option) (*Client, error) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	conn, err := dial(addr, options)
+	if err != nil {
+		return nil, err
+	}
+
+	c := newClient(conn, options)
+
+	//服务端不回复认证时不会一直阻塞
+	if options.DialTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(options.DialTimeout))
+	}
+	if err := c.auth(authData); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	go c.readLoop()
+	go c.heartbeatLoop()
+
+	return c, nil
+}
+
+func newClient(conn net.Conn, opts Options) *Client {
+	seqs := opts.seqs
+	if seqs == nil {
+		seqs = newSeqWindow()
+	}
+
+	return &Client{
+		conn:    conn,
+		opts:    opts,
+		pending: map[uint32]chan reply{},
+		pushC:   make(chan []byte, opts.PushQueueSize),
+		seqs:    seqs,
+		exitC:   make(chan struct{}),
+	}
+}
+
+func (c *Client) auth(data []byte) error {
+	requestId := c.nextRequestId()
+	if err := c.write(consts.CmdAuth, requestId, data); err != nil {
+		return err
+	}
+
+	msg := c.factory().NewMessage()
+	if _, err := msg.ReadFrom(c.conn); err != nil {
+		return err
+	}
+
+	if msg.Cmd() != consts.CmdAuth || msg.RequestId() != requestId {
+		return fmt.Errorf("%w: %v", ErrUnexpectedReply, msg.Cmd())
+	}
+
+	c.authReply = copyBytes(msg.Body())
+	return replyError(msg)
+}
+
+//认证回复的body，认证失败时为错误信息
+func (c *Client) AuthReply() []byte {
+	return c.authReply
+}
+
+//发送 CmdPush 请求并等待回复，服务端回复错误时返回 *Error
+func (c *Client) Request(ctx context.Context, body []byte) ([]byte, error) {
+	return c.request(ctx, consts.CmdPush, body)
+}
+
+//订阅主题，主题的推送和其他推送一样从 Push 或 OnPush 收到
+func (c *Client) Subscribe(ctx context.Context, topic string) error {
+	reply, err := c.request(ctx, consts.CmdSubscribe, []byte(topic))
+	if err != nil {
+		return err
+	}
+	if len(reply) > 0 { //旧版本服务端没有状态码
+		return fmt.Errorf("%w: %s", ErrSubscribe, reply)
+	}
+	return nil
+}
+
+func (c *Client) Unsubscribe(ctx context.Context, topic string) error {
+	_, err := c.request(ctx, consts.CmdUnsubscribe, []byte(topic))
+	return err
+}
+
+//发送自定义命令并等待回复，服务端的 CmdHandler 返回nil时不会回复
+func (c *Client) RequestCmd(ctx context.Context, cmd Interface.Cmd, body []byte) ([]byte, error) {
+	return c.request(ctx, cmd, body)
+}
+
+//发送不需要回复的自定义命令
+func (c *Client) SendCmd(cmd Interface.Cmd, body []byte) error {
+	return c.write(cmd, 0, body)
+}
+
+func (c *Client) request(ctx context.Context, cmd Interface.Cmd, body []byte) ([]byte, error) {
+	requestId := c.nextRequestId()
+	replyC := make(chan reply, 1)
+
+	c.mu.Lock()
+	c.pending[requestId] = replyC
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, requestId)
+		c.mu.Unlock()
+	}()
+
+	if err := c.write(cmd, requestId, body); err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.exitC:
+		return nil, c.Err()
+	case r := <-replyC:
+		return r.body, r.err
+	}
+}
+
+//服务端推送，设置了 OnPush 时不会有数据
+func (c *Client) Push() <-chan []byte {
+	return c.pushC
+}
+
+func (c *Client) Exit() <-chan struct{} {
+	return c.exitC
+}
+
+//连接关闭的原因
+func (c *Client) Err() error {
+	select {
+	case <-c.exitC:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+func (c *Client) Close() error {
+	c.write(consts.CmdClose, 0, nil)
+	return c.close(ErrClosed)
+}
+
+func (c *Client) close(err error) error {
+	var closeErr error
+	c.closeOnce.Do(func() {
+		c.err = err
+		close(c.exitC)
+		closeErr = c.conn.Close()
+	})
+	return closeErr
+}
+
+func (c *Client) readLoop() {
+	var err error
+	defer func() {
+		logger.Debugf("client reader exit: %v", err)
+		c.close(err)
+	}()
+
+	//心跳有回复，超时未收到任何消息时认为连接已断开
+	timeout := c.opts.heartbeatTimeout()
+
+	msg := c.factory().NewMessage()
+	for {
+		if timeout > 0 {
+			c.conn.SetReadDeadline(time.Now().Add(timeout))
+		}
+		if _, err = msg.ReadFrom(c.conn); err != nil {
+			return
+		}
+
+		logger.Debugf("client receive message: %v", msg)
+
+		switch msg.Cmd() {
+		case consts.CmdServerPush:
+			//可靠推送，RequestId 为序号，重发的推送也要确认
+			if seq := msg.RequestId(); seq != 0 {
+				if err = c.write(consts.CmdAck, seq, nil); err != nil {
+					return
+				}
+				if !c.seqs.add(seq) {
+					logger.Debugf("client duplicate push: %v", seq)
+					continue
+				}
+			}
+			c.onPush(copyBytes(msg.Body()))
+		case consts.CmdHeartbeat:
+		case consts.CmdClose: //body为服务端关闭连接的原因
+			err = ErrClosed
+			if len(msg.Body()) > 0 {
+				err = &CloseError{Reason: string(msg.Body())}
+			}
+			return
+		default: //请求的回复，包括自定义命令
+			c.mu.Lock()
+			replyC, ok := c.pending[msg.RequestId()]
+			c.mu.Unlock()
+			if ok {
+				replyC <- reply{body: copyBytes(msg.Body()), err: replyError(msg)}
+			} else {
+				logger.Debugf("client unexpected message: %v", msg.Cmd())
+			}
+		}
+	}
+}
+
+func (c *Client) onPush(data []byte) {
+	if c.opts.OnPush != nil {
+		c.opts.OnPush(data)
+		return
+	}
+
+	select {
+	case <-c.exitC:
+	case c.pushC <- data:
+	}
+}
+
+func (c *Client) heartbeatLoop() {
+	if c.opts.HeartbeatInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(c.opts.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.exitC:
+			return
+		case <-ticker.C:
+			if err := c.write(consts.CmdHeartbeat, c.nextRequestId(), nil); err != nil {
+				c.close(err)
+				return
+			}
+		}
+	}
+}
+
+func (c *Client) write(cmd Interface.Cmd, requestId uint32, body []byte) error {
+	factory := c.factory()
+	msg := factory.GetPoolMsg()
+	msg.SetCmd(cmd).SetRequestId(requestId).SetBody(body)
+	if m, ok := msg.(*binary.Message); ok {
+		//v2头部告诉服务端可以解析回复的状态码
+		m.SetHeaderLen(binary.HeaderLenV2)
+	}
+
+	c.wL.Lock()
+	_, err := msg.WriteTo(c.conn)
+	c.wL.Unlock()
+
+	factory.FreePoolMsg(msg)
+	return err
+}
+
+func (c *Client) nextRequestId() uint32 {
+	for {
+		//0 保留给不需要回复的消息
+		if id := atomic.AddUint32(&c.requestId, 1); id != 0 {
+			return id
+		}
+	}
+}
+
+func (c *Client) factory() *protocol.MsgProtoFactory {
+	return c.opts.MsgFactory
+}
+
+//状态码不为0时返回 *Error
+func replyError(msg Interface.Message) error {
+	if msg.Code() == consts.CodeOk {
+		return nil
+	}
+	return protocol.NewError(msg.Code(), string(msg.Body()))
+}
+
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	cpy := make([]byte, len(data))
+	copy(cpy, data)
+	return cpy
+}
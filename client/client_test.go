@@ -0,0 +1,345 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/kuhufu/cm/protocol"
+	"github.com/kuhufu/cm/protocol/consts"
+	"github.com/kuhufu/cm/server"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type echoHandler struct{}
+
+//data格式 room[:channel]，channel默认为web
+func (h echoHandler) OnAuth(data []byte) *server.AuthReply {
+	ids := strings.SplitN(string(data), ":", 2)
+	if len(ids) == 1 {
+		ids = append(ids, "web")
+	}
+
+	return &server.AuthReply{
+		Ok:        true,
+		RoomId:    ids[0],
+		ChannelId: ids[1],
+		Data:      []byte("hello"),
+	}
+}
+
+func (h echoHandler) OnReceive(channel *server.Channel, data []byte) (resp []byte) {
+	return data
+}
+
+func (h echoHandler) OnClose(channel *server.Channel) {}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func runServer(t *testing.T, scheme string, proto protocol.MsgProto, opts ...server.Option) (*server.Server, string) {
+	host := freeAddr(t)
+	addr := fmt.Sprintf("%v://%v/ws", scheme, host)
+	srv := server.NewServer(append([]server.Option{
+		server.WithHandler(echoHandler{}),
+		server.WithMsgProtocol(proto),
+	}, opts...)...)
+
+	go srv.Run(addr)
+	waitListen(host)
+
+	return srv, addr
+}
+
+func waitListen(host string) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", host)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestClient(t *testing.T) {
+	cases := []struct {
+		scheme string
+		proto  protocol.MsgProto
+	}{
+		{"tcp", protocol.BINARY},
+		{"tcp", protocol.PROTOBUF},
+		{"ws", protocol.BINARY},
+		{"ws", protocol.JSON},
+		{"ws", protocol.PROTOBUF},
+	}
+
+	for _, cs := range cases {
+		srv, addr := runServer(t, cs.scheme, cs.proto)
+
+		c, err := Dial(addr, []byte("1"), WithMsgProtocol(cs.proto))
+		if err != nil {
+			t.Fatalf("%v: %v", addr, err)
+		}
+
+		if string(c.AuthReply()) != "hello" {
+			t.Errorf("%v: wrong auth reply: %s", addr, c.AuthReply())
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		resp, err := c.Request(ctx, []byte("ping"))
+		cancel()
+		if err != nil || string(resp) != "ping" {
+			t.Errorf("%v: wrong response: %s, %v", addr, resp, err)
+		}
+
+		srv.Unicast([]byte("push"), "1")
+		select {
+		case data := <-c.Push():
+			if string(data) != "push" {
+				t.Errorf("%v: wrong push: %s", addr, data)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%v: push timeout", addr)
+		}
+
+		c.Close()
+		srv.Close()
+	}
+}
+
+func TestDial_AuthTimeout(t *testing.T) {
+	//只接受连接，不回复认证
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	_, err = Dial("tcp://"+ln.Addr().String(), []byte("1"), WithDialTimeout(time.Millisecond*100))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("want timeout, got: %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("dial took %v", d)
+	}
+}
+
+func TestReconnectClient(t *testing.T) {
+	srv, addr := runServer(t, "tcp", protocol.BINARY)
+	defer srv.Close()
+
+	connectedC := make(chan struct{}, 2)
+	rc, err := DialReconnect(addr, []byte("2"),
+		WithBackoff(Backoff{Min: time.Millisecond * 10, Max: time.Millisecond * 100, Factor: 2}),
+		WithOnConnected(func(c *Client) {
+			connectedC <- struct{}{}
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	<-connectedC
+
+	//服务端断开连接
+	room, ok := srv.GetRoom("2")
+	if !ok {
+		t.Fatal("room not exist")
+	}
+	channel, _ := room.Get("web")
+	channel.Close()
+
+	select {
+	case <-connectedC:
+	case <-time.After(time.Second):
+		t.Fatal("reconnect timeout")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	resp, err := rc.Request(ctx, []byte("ping"))
+	if err != nil || string(resp) != "ping" {
+		t.Errorf("wrong response: %s, %v", resp, err)
+	}
+}
+
+func TestReconnectClient_Replaced(t *testing.T) {
+	srv, addr := runServer(t, "tcp", protocol.BINARY, server.WithSendCloseReason(true))
+	defer srv.Close()
+
+	opts := []Option{WithBackoff(Backoff{Min: time.Millisecond * 10, Max: time.Millisecond * 100, Factor: 2})}
+	rc1, err := DialReconnect(addr, []byte("22"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc1.Close()
+
+	rc2, err := DialReconnect(addr, []byte("22"), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc2.Close()
+
+	//被替换的客户端不再重连
+	select {
+	case <-rc1.Exit():
+		var e *CloseError
+		if err := rc1.Err(); !errors.As(err, &e) || e.Reason != "replaced" || !errors.Is(err, ErrClosed) {
+			t.Errorf("wrong error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("replaced client still running")
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	select {
+	case <-rc2.Exit():
+		t.Fatalf("client closed: %v", rc2.Err())
+	default:
+	}
+	if c := rc2.Client(); c == nil {
+		t.Error("client not connected")
+	}
+}
+
+func TestClient_HeartbeatTimeout(t *testing.T) {
+	//回复认证后不再回复任何消息，模拟半开连接
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		msg := protocol.GetFactory(protocol.BINARY).NewDefaultMessage()
+		if _, err := msg.ReadFrom(conn); err != nil {
+			return
+		}
+		msg.WriteTo(conn)
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	c, err := Dial("tcp://"+ln.Addr().String(), []byte("1"),
+		WithHeartbeatInterval(time.Millisecond*20),
+		WithHeartbeatTimeout(time.Millisecond*100),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	select {
+	case <-c.Exit():
+		if ne, ok := c.Err().(net.Error); !ok || !ne.Timeout() {
+			t.Errorf("want timeout, got: %v", c.Err())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("half-open connection not detected")
+	}
+}
+
+func TestClient_DuplicatePush(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	acks := make(chan uint32, 4)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		factory := protocol.GetFactory(protocol.BINARY)
+		msg := factory.NewDefaultMessage()
+		if _, err := msg.ReadFrom(conn); err != nil {
+			return
+		}
+		msg.WriteTo(conn)
+
+		//重发的推送序号相同
+		for _, seq := range []uint32{7, 7, 8} {
+			push := factory.NewDefaultMessage().SetCmd(consts.CmdServerPush).SetRequestId(seq).SetBody([]byte(fmt.Sprint(seq)))
+			push.WriteTo(conn)
+		}
+		for {
+			if _, err := msg.ReadFrom(conn); err != nil {
+				return
+			}
+			if msg.Cmd() == consts.CmdAck {
+				acks <- msg.RequestId()
+			}
+		}
+	}()
+
+	c, err := Dial("tcp://"+ln.Addr().String(), []byte("1"), WithHeartbeatInterval(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for _, want := range []string{"7", "8"} {
+		select {
+		case data := <-c.Push():
+			if string(data) != want {
+				t.Errorf("got %s, want %s", data, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v timeout", want)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case <-acks:
+		case <-time.After(time.Second):
+			t.Fatal("ack timeout")
+		}
+	}
+	select {
+	case data := <-c.Push():
+		t.Errorf("duplicate push: %s", data)
+	default:
+	}
+}
+
+func TestBackoff_Duration(t *testing.T) {
+	b := Backoff{Min: time.Second, Max: time.Second * 5, Factor: 2}
+
+	for attempt, want := range []time.Duration{1: time.Second, 2: time.Second * 2, 3: time.Second * 4, 4: time.Second * 5} {
+		if attempt == 0 {
+			continue
+		}
+		if got := b.Duration(attempt); got != want {
+			t.Errorf("attempt %v: got %v, want %v", attempt, got, want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package client
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/gorilla/websocket"
+	"github.com/kuhufu/cm/transport/tcp"
+	"github.com/kuhufu/cm/transport/ws"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var ErrUnsupportedScheme = errors.New("unsupported scheme")
+
+//支持 tcp://host:port, tcp+tls://host:port, ws://host:port/path, wss://host:port/path, unix:///path
+func dial(addr string, opts Options) (net.Conn, error) {
+	parse, err := url.Parse(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: opts.DialTimeout}
+
+	switch parse.Scheme {
+	case "tcp", "tcp4", "tcp6":
+		conn, err := dialer.Dial(parse.Scheme, parse.Host)
+		if err != nil {
+			return nil, err
+		}
+		return &tcp.Conn{
+			Conn:         conn,
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
+		}, nil
+	case "tcp+tls":
+		conn, err := tls.DialWithDialer(dialer, "tcp", parse.Host, opts.TlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		return &tcp.Conn{
+			Conn:         conn,
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
+		}, nil
+	case "unix":
+		conn, err := dialer.Dial("unix", strings.TrimPrefix(addr, "unix://"))
+		if err != nil {
+			return nil, err
+		}
+		return &tcp.Conn{
+			Conn:         conn,
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
+		}, nil
+	case "ws", "wss":
+		wsDialer := websocket.Dialer{
+			NetDial:          dialer.Dial,
+			HandshakeTimeout: opts.DialTimeout,
+			TLSClientConfig:  opts.TlsConfig,
+		}
+		conn, _, err := wsDialer.Dial(addr, nil)
+		if err != nil {
+			return nil, err
+		}
+		return &ws.Conn{
+			Conn:         conn,
+			ReadTimeout:  opts.ReadTimeout,
+			WriteTimeout: opts.WriteTimeout,
+		}, nil
+	default:
+		return nil, ErrUnsupportedScheme
+	}
+}
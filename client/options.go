@@ -0,0 +1,170 @@
+package client
+
+import (
+	"crypto/tls"
+	"github.com/kuhufu/cm/protocol"
+	"time"
+)
+
+type Options struct {
+	//心跳间隔，默认30s，需小于服务端的心跳超时时间
+	HeartbeatInterval time.Duration
+	//超过这个时间没有收到服务端的任何消息(包括心跳回复)时断开连接，默认为心跳间隔的2倍
+	HeartbeatTimeout time.Duration
+	//连接和认证的超时时间，默认10s
+	DialTimeout time.Duration
+	//读超时时间，0表示不超时
+	ReadTimeout time.Duration
+	//写超时时间，0表示不超时
+	WriteTimeout time.Duration
+	//tls配置，tcp+tls 和 wss 使用
+	TlsConfig *tls.Config
+	//服务端推送回调，为nil时推送消息进入 Client.Push()
+	OnPush func(data []byte)
+	//推送队列长度，默认16
+	PushQueueSize int
+
+	MsgFactory *protocol.MsgProtoFactory
+
+	//以下仅 ReconnectClient 使用
+
+	//重连退避策略
+	Backoff Backoff
+	//最大连续重连次数，0表示不限制
+	MaxReconnectAttempts int
+	//服务端以这些原因关闭连接时不再重连，默认 replaced、kicked、evicted，见 CloseError
+	//服务端 Kick 指定了reason时需要加入该reason
+	TerminalCloseReasons []string
+	//连接(重连)并认证成功
+	OnConnected func(c *Client)
+	//连接断开
+	OnDisconnected func(err error)
+	//即将进行第attempt次重连，delay后开始
+	OnReconnecting func(attempt int, delay time.Duration)
+
+	//各连接共用，重连后重放的推送也能去重
+	seqs *seqWindow
+}
+
+func defaultOptions() Options {
+	return Options{
+		HeartbeatInterval: time.Second * 30,
+		DialTimeout:       time.Second * 10,
+		PushQueueSize:     16,
+		MsgFactory:        protocol.GetFactory(protocol.BINARY),
+		Backoff:           DefaultBackoff,
+
+		TerminalCloseReasons: []string{"replaced", "kicked", "evicted"},
+	}
+}
+
+func (o *Options) heartbeatTimeout() time.Duration {
+	if o.HeartbeatTimeout > 0 {
+		return o.HeartbeatTimeout
+	}
+	return o.HeartbeatInterval * 2
+}
+
+type Option func(o *Options)
+
+func WithHeartbeatInterval(duration time.Duration) Option {
+	return func(o *Options) {
+		o.HeartbeatInterval = duration
+	}
+}
+
+func WithHeartbeatTimeout(duration time.Duration) Option {
+	return func(o *Options) {
+		o.HeartbeatTimeout = duration
+	}
+}
+
+func WithDialTimeout(duration time.Duration) Option {
+	return func(o *Options) {
+		o.DialTimeout = duration
+	}
+}
+
+func WithReadTimeout(duration time.Duration) Option {
+	return func(o *Options) {
+		o.ReadTimeout = duration
+	}
+}
+
+func WithWriteTimeout(duration time.Duration) Option {
+	return func(o *Options) {
+		o.WriteTimeout = duration
+	}
+}
+
+func WithTlsConfig(config *tls.Config) Option {
+	return func(o *Options) {
+		o.TlsConfig = config
+	}
+}
+
+func WithOnPush(f func(data []byte)) Option {
+	return func(o *Options) {
+		o.OnPush = f
+	}
+}
+
+func WithPushQueueSize(size int) Option {
+	return func(o *Options) {
+		o.PushQueueSize = size
+	}
+}
+
+func WithMsgProtocol(proto protocol.MsgProto) Option {
+	return func(o *Options) {
+		o.MsgFactory = protocol.GetFactory(proto)
+	}
+}
+
+func WithMsgFactory(factory *protocol.MsgProtoFactory) Option {
+	return func(o *Options) {
+		o.MsgFactory = factory
+	}
+}
+
+func WithBackoff(backoff Backoff) Option {
+	return func(o *Options) {
+		o.Backoff = backoff
+	}
+}
+
+func WithMaxReconnectAttempts(n int) Option {
+	return func(o *Options) {
+		o.MaxReconnectAttempts = n
+	}
+}
+
+func WithTerminalCloseReasons(reasons ...string) Option {
+	return func(o *Options) {
+		o.TerminalCloseReasons = reasons
+	}
+}
+
+func withSeqWindow(seqs *seqWindow) Option {
+	return func(o *Options) {
+		o.seqs = seqs
+	}
+}
+
+func WithOnConnected(f func(c *Client)) Option {
+	return func(o *Options) {
+		o.OnConnected = f
+	}
+}
+
+func WithOnDisconnected(f func(err error)) Option {
+	return func(o *Options) {
+		o.OnDisconnected = f
+	}
+}
+
+func WithOnReconnecting(f func(attempt int, delay time.Duration)) Option {
+	return func(o *Options) {
+		o.OnReconnecting = f
+	}
+}
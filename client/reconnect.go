@@ -0,0 +1,299 @@
+package client
+
+import (
+	"context"
+	"errors"
+	logger "github.com/kuhufu/cm/logger"
+	"sync"
+	"time"
+)
+
+//断线后自动重连并重新认证的客户端
+//服务端对相同 ChannelId 的新连接会替换旧连接，所以重连对服务端是透明的
+//被新连接替换、被踢下线、被多端登录策略踢掉时不再重连，否则相同 ChannelId 的两个客户端会互相替换，见 Options.TerminalCloseReasons
+type ReconnectClient struct {
+	addr    string
+	opts    []Option
+	options Options
+
+	mu       sync.RWMutex
+	authData []byte
+	client   *Client
+	readyC   chan struct{}       //连接可用时关闭，断开后重新创建
+	topics   map[string]struct{} //重连后重新订阅
+
+	pushC     chan []byte
+	exitC     chan struct{}
+	closeOnce sync.Once
+	err       error
+}
+
+//第一次连接失败直接返回错误，之后断线会在后台重连
+func DialReconnect(addr string, authData []byte, opts ...Option) (*ReconnectClient, error) {
+	options := defaultOptions()
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	rc := &ReconnectClient{
+		addr:     addr,
+		options:  options,
+		authData: authData,
+		readyC:   make(chan struct{}),
+		topics:   map[string]struct{}{},
+		pushC:    make(chan []byte, options.PushQueueSize),
+		exitC:    make(chan struct{}),
+	}
+
+	//推送统一从 ReconnectClient 出去，连接切换时不会丢失订阅者
+	rc.opts = append(append([]Option{}, opts...), WithOnPush(rc.onPush), withSeqWindow(newSeqWindow()))
+
+	c, err := Dial(addr, authData, rc.opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.setClient(c)
+	go rc.run(c)
+
+	return rc, nil
+}
+
+//更新缓存的认证信息，下次重连时使用
+func (rc *ReconnectClient) SetAuthData(data []byte) {
+	rc.mu.Lock()
+	rc.authData = data
+	rc.mu.Unlock()
+}
+
+//当前连接，重连过程中为nil
+func (rc *ReconnectClient) Client() *Client {
+	rc.mu.RLock()
+	defer rc.mu.RUnlock()
+	return rc.client
+}
+
+//等待连接可用后发送请求
+func (rc *ReconnectClient) Request(ctx context.Context, body []byte) ([]byte, error) {
+	c, err := rc.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return c.Request(ctx, body)
+}
+
+//订阅成功的主题在重连后自动重新订阅
+func (rc *ReconnectClient) Subscribe(ctx context.Context, topic string) error {
+	c, err := rc.wait(ctx)
+	if err != nil {
+		return err
+	}
+	if err := c.Subscribe(ctx, topic); err != nil {
+		return err
+	}
+
+	rc.mu.Lock()
+	rc.topics[topic] = struct{}{}
+	rc.mu.Unlock()
+	return nil
+}
+
+func (rc *ReconnectClient) Unsubscribe(ctx context.Context, topic string) error {
+	rc.mu.Lock()
+	delete(rc.topics, topic)
+	rc.mu.Unlock()
+
+	c, err := rc.wait(ctx)
+	if err != nil {
+		return err
+	}
+	return c.Unsubscribe(ctx, topic)
+}
+
+//等待连接可用
+func (rc *ReconnectClient) wait(ctx context.Context) (*Client, error) {
+	for {
+		rc.mu.RLock()
+		c, readyC := rc.client, rc.readyC
+		rc.mu.RUnlock()
+
+		if c != nil {
+			return c, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-rc.exitC:
+			return nil, rc.Err()
+		case <-readyC:
+		}
+	}
+}
+
+func (rc *ReconnectClient) Push() <-chan []byte {
+	return rc.pushC
+}
+
+func (rc *ReconnectClient) Exit() <-chan struct{} {
+	return rc.exitC
+}
+
+func (rc *ReconnectClient) Err() error {
+	select {
+	case <-rc.exitC:
+		return rc.err
+	default:
+		return nil
+	}
+}
+
+func (rc *ReconnectClient) Close() error {
+	rc.close(ErrClosed)
+
+	if c := rc.Client(); c != nil {
+		return c.Close()
+	}
+	return nil
+}
+
+func (rc *ReconnectClient) close(err error) {
+	rc.closeOnce.Do(func() {
+		rc.err = err
+		close(rc.exitC)
+	})
+}
+
+func (rc *ReconnectClient) run(c *Client) {
+	if rc.options.OnConnected != nil {
+		rc.options.OnConnected(c)
+	}
+
+	for {
+		select {
+		case <-rc.exitC:
+			c.Close()
+			return
+		case <-c.Exit():
+		}
+
+		err := c.Err()
+		rc.setClient(nil)
+		logger.Debugf("client disconnected: %v", err)
+
+		if rc.options.OnDisconnected != nil {
+			rc.options.OnDisconnected(err)
+		}
+
+		if rc.terminal(err) {
+			rc.close(err)
+			return
+		}
+
+		if c = rc.reconnect(); c == nil {
+			return
+		}
+	}
+}
+
+func (rc *ReconnectClient) reconnect() *Client {
+	for attempt := 1; ; attempt++ {
+		delay := rc.options.Backoff.Duration(attempt)
+		if rc.options.OnReconnecting != nil {
+			rc.options.OnReconnecting(attempt, delay)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-rc.exitC:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+
+		rc.mu.RLock()
+		authData := rc.authData
+		rc.mu.RUnlock()
+
+		c, err := Dial(rc.addr, authData, rc.opts...)
+		if err != nil {
+			logger.Debugf("client reconnect attempt %v: %v", attempt, err)
+			if rc.options.MaxReconnectAttempts > 0 && attempt >= rc.options.MaxReconnectAttempts {
+				rc.close(err)
+				return nil
+			}
+			continue
+		}
+
+		//重连过程中被关闭
+		select {
+		case <-rc.exitC:
+			c.Close()
+			return nil
+		default:
+		}
+
+		rc.resubscribe(c)
+		rc.setClient(c)
+		if rc.options.OnConnected != nil {
+			rc.options.OnConnected(c)
+		}
+		return c
+	}
+}
+
+//服务端以 TerminalCloseReasons 中的原因关闭连接
+func (rc *ReconnectClient) terminal(err error) bool {
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) {
+		return false
+	}
+	for _, reason := range rc.options.TerminalCloseReasons {
+		if closeErr.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func (rc *ReconnectClient) resubscribe(c *Client) {
+	rc.mu.RLock()
+	topics := make([]string, 0, len(rc.topics))
+	for topic := range rc.topics {
+		topics = append(topics, topic)
+	}
+	rc.mu.RUnlock()
+
+	for _, topic := range topics {
+		ctx, cancel := context.WithTimeout(context.Background(), rc.options.DialTimeout)
+		err := c.Subscribe(ctx, topic)
+		cancel()
+		if err != nil {
+			logger.Errorf("client resubscribe %v error: %v", topic, err)
+		}
+	}
+}
+
+func (rc *ReconnectClient) setClient(c *Client) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	rc.client = c
+	if c != nil {
+		close(rc.readyC)
+	} else {
+		rc.readyC = make(chan struct{})
+	}
+}
+
+func (rc *ReconnectClient) onPush(data []byte) {
+	if rc.options.OnPush != nil {
+		rc.options.OnPush(data)
+		return
+	}
+
+	select {
+	case <-rc.exitC:
+	case rc.pushC <- data:
+	}
+}
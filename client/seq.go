@@ -0,0 +1,41 @@
+package client
+
+import "sync"
+
+//记住的可靠推送序号个数
+const seqWindowSize = 1024
+
+//最近收到的可靠推送序号，重发的推送只确认，不再交给应用
+type seqWindow struct {
+	mu   sync.Mutex
+	seen map[uint32]struct{}
+	ring []uint32
+	next int
+}
+
+func newSeqWindow() *seqWindow {
+	return &seqWindow{
+		seen: make(map[uint32]struct{}, seqWindowSize),
+		ring: make([]uint32, 0, seqWindowSize),
+	}
+}
+
+//seq 第一次收到时返回true
+func (w *seqWindow) add(seq uint32) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if _, ok := w.seen[seq]; ok {
+		return false
+	}
+
+	if len(w.ring) < seqWindowSize {
+		w.ring = append(w.ring, seq)
+	} else {
+		delete(w.seen, w.ring[w.next])
+		w.ring[w.next] = seq
+		w.next = (w.next + 1) % seqWindowSize
+	}
+	w.seen[seq] = struct{}{}
+	return true
+}
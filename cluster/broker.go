@@ -0,0 +1,60 @@
+package cluster
+
+import "errors"
+
+var (
+	ErrNodeNotExist  = errors.New("node not exist")
+	ErrClosed        = errors.New("broker closed")
+	ErrFrameTooLarge = errors.New("frame too large")
+)
+
+type MessageType int
+
+const (
+	MsgRoomOnline  MessageType = iota + 1 //RoomIds 在 From 节点上有连接
+	MsgRoomOffline                        //RoomIds 在 From 节点上没有连接了
+	MsgSync                               //RoomIds 为 From 节点的全部房间，Reply 为true时接收方需回复自己的全部房间
+	MsgPush                               //推送 Data 到本节点的 RoomIds
+	MsgBroadcast                          //推送 Data 到本节点的所有连接
+	MsgPublish                            //推送 Data 到本节点订阅了 Topic 的连接
+	MsgNodeJoin                           //From 节点连接上本节点，由 Broker 产生
+	MsgNodeLeave                          //From 节点断开，由 Broker 产生
+)
+
+var messageTypeMap = map[MessageType]string{
+	MsgRoomOnline:  "RoomOnline",
+	MsgRoomOffline: "RoomOffline",
+	MsgSync:        "Sync",
+	MsgPush:        "Push",
+	MsgBroadcast:   "Broadcast",
+	MsgPublish:     "Publish",
+	MsgNodeJoin:    "NodeJoin",
+	MsgNodeLeave:   "NodeLeave",
+}
+
+func (t MessageType) String() string {
+	return messageTypeMap[t]
+}
+
+//节点之间传递的消息
+type Message struct {
+	Type    MessageType `json:"type"`
+	From    string      `json:"from"`
+	RoomIds []string    `json:"room_ids,omitempty"`
+	Topic   string      `json:"topic,omitempty"`
+	Data    []byte      `json:"data,omitempty"`
+	Reply   bool        `json:"reply,omitempty"`
+}
+
+//节点之间的消息传输
+type Broker interface {
+	//本节点id
+	NodeId() string
+	//开始接收其他节点发给本节点的消息，handler 串行调用
+	Start(handler func(msg *Message)) error
+	//发送给除本节点外的所有节点
+	Publish(msg *Message) error
+	//发送给指定节点
+	Send(nodeId string, msg *Message) error
+	Close() error
+}
@@ -0,0 +1,108 @@
+package cluster
+
+import "sync"
+
+//进程内的节点集合，用于测试或单进程多 Server
+type LocalHub struct {
+	mu    sync.RWMutex
+	nodes map[string]*LocalBroker
+}
+
+func NewLocalHub() *LocalHub {
+	return &LocalHub{
+		nodes: map[string]*LocalBroker{},
+	}
+}
+
+func (h *LocalHub) NewBroker(nodeId string) *LocalBroker {
+	return &LocalBroker{
+		hub:     h,
+		nodeId:  nodeId,
+		mailbox: newMailbox(),
+	}
+}
+
+func (h *LocalHub) others(nodeId string) []*LocalBroker {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	list := make([]*LocalBroker, 0, len(h.nodes))
+	for id, b := range h.nodes {
+		if id != nodeId {
+			list = append(list, b)
+		}
+	}
+	return list
+}
+
+type LocalBroker struct {
+	hub     *LocalHub
+	nodeId  string
+	mailbox *mailbox
+}
+
+func (b *LocalBroker) NodeId() string {
+	return b.nodeId
+}
+
+func (b *LocalBroker) Start(handler func(msg *Message)) error {
+	b.hub.mu.Lock()
+	b.hub.nodes[b.nodeId] = b
+	b.hub.mu.Unlock()
+
+	go b.mailbox.run(handler)
+	return nil
+}
+
+func (b *LocalBroker) Publish(msg *Message) error {
+	if b.closed() {
+		return ErrClosed
+	}
+
+	msg.From = b.nodeId
+	for _, node := range b.hub.others(b.nodeId) {
+		node.mailbox.put(msg)
+	}
+	return nil
+}
+
+func (b *LocalBroker) Send(nodeId string, msg *Message) error {
+	if b.closed() {
+		return ErrClosed
+	}
+
+	b.hub.mu.RLock()
+	node, ok := b.hub.nodes[nodeId]
+	b.hub.mu.RUnlock()
+
+	if !ok {
+		return ErrNodeNotExist
+	}
+
+	msg.From = b.nodeId
+	node.mailbox.put(msg)
+	return nil
+}
+
+func (b *LocalBroker) Close() error {
+	b.hub.mu.Lock()
+	delete(b.hub.nodes, b.nodeId)
+	b.hub.mu.Unlock()
+
+	b.mailbox.close()
+
+	leave := &Message{Type: MsgNodeLeave, From: b.nodeId}
+	for _, node := range b.hub.others(b.nodeId) {
+		node.mailbox.put(leave)
+	}
+	return nil
+}
+
+func (b *LocalBroker) closed() bool {
+	select {
+	case <-b.mailbox.exitC:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,56 @@
+package cluster
+
+import "sync"
+
+//无界消息队列，避免两个节点互相发送时因队列满而死锁
+type mailbox struct {
+	mu       sync.Mutex
+	messages []*Message
+	notifyC  chan struct{}
+	exitC    chan struct{}
+	once     sync.Once
+}
+
+func newMailbox() *mailbox {
+	return &mailbox{
+		notifyC: make(chan struct{}, 1),
+		exitC:   make(chan struct{}),
+	}
+}
+
+func (m *mailbox) put(msg *Message) {
+	m.mu.Lock()
+	m.messages = append(m.messages, msg)
+	m.mu.Unlock()
+
+	select {
+	case m.notifyC <- struct{}{}:
+	default:
+	}
+}
+
+//串行调用handler，直到close
+func (m *mailbox) run(handler func(msg *Message)) {
+	for {
+		select {
+		case <-m.exitC:
+			return
+		case <-m.notifyC:
+		}
+
+		m.mu.Lock()
+		messages := m.messages
+		m.messages = nil
+		m.mu.Unlock()
+
+		for _, msg := range messages {
+			handler(msg)
+		}
+	}
+}
+
+func (m *mailbox) close() {
+	m.once.Do(func() {
+		close(m.exitC)
+	})
+}
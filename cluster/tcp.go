@@ -0,0 +1,334 @@
+package cluster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	logger "github.com/kuhufu/cm/logger"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+)
+
+//单条消息最大长度
+const maxFrameLen = 64 << 20
+
+//基于TCP的Broker，节点列表固定
+//每个节点监听 addr，发送时主动连接其他节点，连接上的第一条消息为握手，From 为发送方节点id
+//消息格式: len uint32(BigEndian) | json
+type TCPBroker struct {
+	nodeId       string
+	addr         string
+	peers        map[string]*peer //node_id -> 节点，不包括自己，创建后不变
+	dialTimeout  time.Duration
+	writeTimeout time.Duration
+
+	mu      sync.Mutex
+	inbound map[net.Conn]string //接收连接 -> 对方节点id
+
+	ln      net.Listener
+	mailbox *mailbox
+	exitC   chan struct{}
+	once    sync.Once
+}
+
+//其他节点，每个节点一个发送连接
+//mu 只保护该节点的连接，连接或写入慢的节点不影响发给其他节点
+type peer struct {
+	addr string
+	mu   sync.Mutex
+	conn net.Conn //未连接时为nil
+}
+
+//peers 为 node_id -> addr，可以包括自己
+func NewTCPBroker(nodeId string, addr string, peers map[string]string) *TCPBroker {
+	others := map[string]*peer{}
+	for id, peerAddr := range peers {
+		if id != nodeId {
+			others[id] = &peer{addr: peerAddr}
+		}
+	}
+
+	return &TCPBroker{
+		nodeId:       nodeId,
+		addr:         addr,
+		peers:        others,
+		dialTimeout:  time.Second * 3,
+		writeTimeout: time.Second * 3,
+		inbound:      map[net.Conn]string{},
+		mailbox:      newMailbox(),
+		exitC:        make(chan struct{}),
+	}
+}
+
+func (b *TCPBroker) NodeId() string {
+	return b.nodeId
+}
+
+//监听的地址，addr 端口为0时可用于获取实际端口
+func (b *TCPBroker) Addr() net.Addr {
+	if b.ln == nil {
+		return nil
+	}
+	return b.ln.Addr()
+}
+
+func (b *TCPBroker) Start(handler func(msg *Message)) error {
+	ln, err := net.Listen("tcp", b.addr)
+	if err != nil {
+		return err
+	}
+	b.ln = ln
+
+	go b.mailbox.run(handler)
+	go b.acceptLoop()
+	return nil
+}
+
+func (b *TCPBroker) acceptLoop() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			select {
+			case <-b.exitC:
+				return
+			default:
+			}
+			logger.Error(err)
+			return
+		}
+
+		go b.readLoop(conn)
+	}
+}
+
+func (b *TCPBroker) readLoop(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+
+	hello, err := readFrame(r)
+	if err != nil {
+		logger.Debugf("cluster handshake failed: %v", err)
+		return
+	}
+	from := hello.From
+
+	b.mu.Lock()
+	b.inbound[conn] = from
+	b.mu.Unlock()
+
+	b.mailbox.put(&Message{Type: MsgNodeJoin, From: from})
+
+	for {
+		msg, err := readFrame(r)
+		if err != nil {
+			logger.Debugf("cluster node %v disconnect: %v", from, err)
+			if b.removeInbound(conn) {
+				b.mailbox.put(&Message{Type: MsgNodeLeave, From: from})
+			}
+			return
+		}
+		msg.From = from
+		b.mailbox.put(msg)
+	}
+}
+
+//返回是否是该节点的最后一个接收连接，对方重连时旧连接晚于新连接断开不算离开
+func (b *TCPBroker) removeInbound(conn net.Conn) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	from := b.inbound[conn]
+	delete(b.inbound, conn)
+
+	select {
+	case <-b.exitC:
+		return false
+	default:
+	}
+
+	for _, id := range b.inbound {
+		if id == from {
+			return false
+		}
+	}
+	return true
+}
+
+//同时发给各节点，连接不上的节点会被跳过，返回最后一个错误
+func (b *TCPBroker) Publish(msg *Message) error {
+	msg.From = b.nodeId
+	frame, err := encodeFrame(msg)
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		lastErr error
+	)
+	for _, p := range b.peers {
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+			if err := b.send(p, frame); err != nil {
+				mu.Lock()
+				lastErr = err
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	return lastErr
+}
+
+func (b *TCPBroker) Send(nodeId string, msg *Message) error {
+	p, ok := b.peers[nodeId]
+	if !ok {
+		return ErrNodeNotExist
+	}
+
+	msg.From = b.nodeId
+	frame, err := encodeFrame(msg)
+	if err != nil {
+		return err
+	}
+	return b.send(p, frame)
+}
+
+func (b *TCPBroker) send(p *peer, frame []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	select {
+	case <-b.exitC:
+		return ErrClosed
+	default:
+	}
+
+	if err := b.write(p, frame); err != nil {
+		//连接已失效，重连后重试一次
+		return b.write(p, frame)
+	}
+	return nil
+}
+
+//调用方持有 p.mu，写入失败时关闭连接
+func (b *TCPBroker) write(p *peer, frame []byte) error {
+	conn, err := b.getConn(p)
+	if err != nil {
+		return err
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(b.writeTimeout))
+	if _, err := conn.Write(frame); err != nil {
+		conn.Close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+//调用方持有 p.mu
+func (b *TCPBroker) getConn(p *peer) (net.Conn, error) {
+	if p.conn != nil {
+		return p.conn, nil
+	}
+
+	conn, err := net.DialTimeout("tcp", p.addr, b.dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	hello, _ := encodeFrame(&Message{From: b.nodeId})
+	conn.SetWriteDeadline(time.Now().Add(b.writeTimeout))
+	if _, err := conn.Write(hello); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	//对方只发不收，丢弃读到的数据以便发现连接断开
+	//断开后清除连接，否则对方重启后第一次写入旧连接不会报错，消息丢失
+	go func() {
+		io.Copy(ioutil.Discard, conn)
+		conn.Close()
+
+		p.mu.Lock()
+		if p.conn == conn {
+			p.conn = nil
+		}
+		p.mu.Unlock()
+	}()
+
+	p.conn = conn
+	return conn, nil
+}
+
+func (b *TCPBroker) Close() error {
+	var err error
+	b.once.Do(func() {
+		close(b.exitC)
+
+		if b.ln != nil {
+			err = b.ln.Close()
+		}
+
+		//等待正在进行的发送结束，之后的发送返回 ErrClosed
+		for _, p := range b.peers {
+			p.mu.Lock()
+			if p.conn != nil {
+				p.conn.Close()
+				p.conn = nil
+			}
+			p.mu.Unlock()
+		}
+
+		b.mu.Lock()
+		for conn := range b.inbound {
+			conn.Close()
+		}
+		b.mu.Unlock()
+
+		b.mailbox.close()
+	})
+	return err
+}
+
+func encodeFrame(msg *Message) ([]byte, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	return frame, nil
+}
+
+func readFrame(r io.Reader) (*Message, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	n := binary.BigEndian.Uint32(header[:])
+	if n > maxFrameLen {
+		return nil, ErrFrameTooLarge
+	}
+
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+
+	msg := &Message{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
@@ -0,0 +1,67 @@
+package cluster
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+//对方重启后，发给它的第一条消息不能因为旧连接丢失
+func TestTCPBroker_PeerRestart(t *testing.T) {
+	peers := map[string]string{"a": freeAddr(t), "b": freeAddr(t)}
+
+	a := NewTCPBroker("a", peers["a"], peers)
+	if err := a.Start(func(msg *Message) {}); err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	start := func() (*TCPBroker, chan *Message) {
+		msgC := make(chan *Message, 8)
+		b := NewTCPBroker("b", peers["b"], peers)
+		if err := b.Start(func(msg *Message) {
+			if msg.Type == MsgPush {
+				msgC <- msg
+			}
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return b, msgC
+	}
+
+	expect := func(msgC chan *Message, want string) {
+		select {
+		case msg := <-msgC:
+			if string(msg.Data) != want {
+				t.Errorf("got %s, want %v", msg.Data, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v not received", want)
+		}
+	}
+
+	b, msgC := start()
+	if err := a.Send("b", &Message{Type: MsgPush, Data: []byte("1")}); err != nil {
+		t.Fatal(err)
+	}
+	expect(msgC, "1")
+
+	b.Close()
+	time.Sleep(time.Millisecond * 50) //等待a发现连接断开
+
+	b, msgC = start()
+	defer b.Close()
+	if err := a.Send("b", &Message{Type: MsgPush, Data: []byte("2")}); err != nil {
+		t.Fatal(err)
+	}
+	expect(msgC, "2")
+}
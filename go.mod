@@ -4,5 +4,5 @@ go 1.13
 
 require (
 	github.com/gorilla/websocket v1.4.1
-	google.golang.org/protobuf v1.25.0 // indirect
+	google.golang.org/protobuf v1.25.0
 )
@@ -0,0 +1,273 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+//默认的直方图区间，单位秒
+var DefaultBuckets = []float64{.0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5}
+
+//按 Prometheus 文本格式输出注册的指标，不依赖 Prometheus 客户端
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+	names   map[string]struct{}
+}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		names: map[string]struct{}{},
+	}
+}
+
+//名字重复时panic
+func (r *Registry) register(name string, m metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.names[name]; ok {
+		panic("duplicate metric: " + name)
+	}
+	r.names[name] = struct{}{}
+	r.metrics = append(r.metrics, m)
+}
+
+func (r *Registry) NewCounter(name string, help string) *Counter {
+	c := &Counter{desc: desc{name: name, help: help, typ: "counter"}}
+	r.register(name, c)
+	return c
+}
+
+//带一个标签的计数器，标签值在第一次使用时创建
+func (r *Registry) NewCounterVec(name string, help string, label string) *CounterVec {
+	c := &CounterVec{desc: desc{name: name, help: help, typ: "counter"}, label: label}
+	r.register(name, c)
+	return c
+}
+
+//输出时调用f取值
+func (r *Registry) NewGaugeFunc(name string, help string, f func() float64) {
+	r.register(name, &funcMetric{desc: desc{name: name, help: help, typ: "gauge"}, f: f})
+}
+
+//输出时调用f取得各标签值的计数，用于已有的统计
+func (r *Registry) NewCounterVecFunc(name string, help string, label string, f func() map[string]float64) {
+	r.register(name, &vecFuncMetric{desc: desc{name: name, help: help, typ: "counter"}, label: label, f: f})
+}
+
+//buckets 为各区间的上限，从小到大
+func (r *Registry) NewHistogram(name string, help string, buckets []float64) *Histogram {
+	h := &Histogram{
+		desc:    desc{name: name, help: help, typ: "histogram"},
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+	r.register(name, h)
+	return h
+}
+
+//按注册顺序输出所有指标
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	metrics := append([]metric{}, r.metrics...)
+	r.mu.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+type desc struct {
+	name string
+	help string
+	typ  string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %v %v\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %v %v\n", d.name, d.typ)
+}
+
+type Counter struct {
+	desc
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	writeSample(w, c.name, "", "", float64(c.Value()))
+}
+
+type CounterVec struct {
+	desc
+	label    string
+	counters sync.Map //标签值 -> *Counter
+}
+
+func (c *CounterVec) With(value string) *Counter {
+	if counter, ok := c.counters.Load(value); ok {
+		return counter.(*Counter)
+	}
+	counter, _ := c.counters.LoadOrStore(value, &Counter{})
+	return counter.(*Counter)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	values := map[string]float64{}
+	c.counters.Range(func(key, value interface{}) bool {
+		values[key.(string)] = float64(value.(*Counter).Value())
+		return true
+	})
+
+	c.writeHeader(w)
+	writeSamples(w, c.name, c.label, values)
+}
+
+type funcMetric struct {
+	desc
+	f func() float64
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	writeSample(w, m.name, "", "", m.f())
+}
+
+type vecFuncMetric struct {
+	desc
+	label string
+	f     func() map[string]float64
+}
+
+func (m *vecFuncMetric) write(w *bufio.Writer) {
+	m.writeHeader(w)
+	writeSamples(w, m.name, m.label, m.f())
+}
+
+type Histogram struct {
+	desc
+	buckets []float64
+	counts  []uint64 //最后一个为 +Inf
+	sumBits uint64   //float64
+	count   uint64
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.buckets, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.writeHeader(w)
+
+	//各区间是累计值
+	var cumulative uint64
+	for i, upper := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.counts[i])
+		writeSample(w, h.name+"_bucket", "le", formatFloat(upper), float64(cumulative))
+	}
+	cumulative += atomic.LoadUint64(&h.counts[len(h.buckets)])
+	writeSample(w, h.name+"_bucket", "le", "+Inf", float64(cumulative))
+	writeSample(w, h.name+"_sum", "", "", math.Float64frombits(atomic.LoadUint64(&h.sumBits)))
+	writeSample(w, h.name+"_count", "", "", float64(atomic.LoadUint64(&h.count)))
+}
+
+//按标签值排序输出
+func writeSamples(w *bufio.Writer, name string, label string, values map[string]float64) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		writeSample(w, name, label, key, values[key])
+	}
+}
+
+func writeSample(w *bufio.Writer, name string, label string, value string, v float64) {
+	w.WriteString(name)
+	if label != "" {
+		fmt.Fprintf(w, `{%v="%v"}`, label, escapeLabel(value))
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var (
+	helpReplacer  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelReplacer = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func escapeHelp(s string) string {
+	return helpReplacer.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelReplacer.Replace(s)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
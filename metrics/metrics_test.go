@@ -0,0 +1,64 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRegistry_WriteTo(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Requests.").Add(3)
+
+	vec := r.NewCounterVec("messages_total", "Messages by cmd.", "cmd")
+	vec.With("push").Inc()
+	vec.With(`a"b`).Inc()
+	vec.With("push").Inc()
+
+	r.NewGaugeFunc("rooms", "Rooms.", func() float64 { return 2 })
+
+	h := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.1)
+	h.Observe(0.5)
+	h.Observe(2)
+
+	buf := &bytes.Buffer{}
+	if _, err := r.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	want := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total 3
+# HELP messages_total Messages by cmd.
+# TYPE messages_total counter
+messages_total{cmd="a\"b"} 1
+messages_total{cmd="push"} 2
+# HELP rooms Rooms.
+# TYPE rooms gauge
+rooms 2
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 2.65
+latency_seconds_count 4
+`
+	if buf.String() != want {
+		t.Errorf("got:\n%v\nwant:\n%v", buf.String(), want)
+	}
+}
+
+func TestRegistry_Duplicate(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("requests_total", "Requests.")
+
+	defer func() {
+		if err := recover(); err == nil || !strings.Contains(err.(string), "requests_total") {
+			t.Errorf("wrong panic: %v", err)
+		}
+	}()
+	r.NewCounter("requests_total", "Requests.")
+}
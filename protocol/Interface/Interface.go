@@ -3,6 +3,7 @@ package Interface
 import (
 	"github.com/kuhufu/cm/protocol/consts"
 	"io"
+	"sync"
 )
 
 type Message interface {
@@ -14,23 +15,40 @@ type Message interface {
 	Cmd() Cmd
 	Body() []byte
 	RequestId() uint32
+	//状态码，0表示成功，不为0时body为错误信息
+	Code() uint32
 
 	SetCmd(Cmd) Message
 	SetBody([]byte) Message
 	SetRequestId(uint32) Message
+	SetCode(uint32) Message
 }
 
 type Cmd uint32
 
+var cmdMu sync.RWMutex
+
 var cmdMap = map[Cmd]string{
-	consts.CmdUnknown:    "CmdUnknown",
-	consts.CmdAuth:       "CmdAuth",
-	consts.CmdPush:       "CmdPush",
-	consts.CmdHeartbeat:  "CmdHeartbeat",
-	consts.CmdClose:      "CmdClose",
-	consts.CmdServerPush: "CmdServerPush",
+	consts.CmdUnknown:     "CmdUnknown",
+	consts.CmdAuth:        "CmdAuth",
+	consts.CmdPush:        "CmdPush",
+	consts.CmdHeartbeat:   "CmdHeartbeat",
+	consts.CmdClose:       "CmdClose",
+	consts.CmdServerPush:  "CmdServerPush",
+	consts.CmdAck:         "CmdAck",
+	consts.CmdSubscribe:   "CmdSubscribe",
+	consts.CmdUnsubscribe: "CmdUnsubscribe",
 }
 
 func (c Cmd) String() string {
+	cmdMu.RLock()
+	defer cmdMu.RUnlock()
 	return cmdMap[c]
 }
+
+//注册自定义命令的名字
+func RegisterCmd(cmd Cmd, name string) {
+	cmdMu.Lock()
+	defer cmdMu.Unlock()
+	cmdMap[cmd] = name
+}
@@ -12,26 +12,21 @@ import (
 
 type Cmd uint32
 
-var cmdMap = map[Cmd]string{
-	CmdUnknown:    "CmdUnknown",
-	CmdAuth:       "CmdAuth",
-	CmdPush:       "CmdPush",
-	CmdHeartbeat:  "CmdHeartbeat",
-	CmdClose:      "CmdClose",
-	CmdServerPush: "CmdServerPush",
-}
-
+//与 Interface.Cmd 共用名字，包括注册的自定义命令
 func (c Cmd) String() string {
-	return cmdMap[c]
+	return Interface.Cmd(c).String()
 }
 
 const (
-	CmdUnknown    = Cmd(0)
-	CmdAuth       = Cmd(1)
-	CmdPush       = Cmd(2)
-	CmdHeartbeat  = Cmd(3)
-	CmdClose      = Cmd(4)
-	CmdServerPush = Cmd(5)
+	CmdUnknown     = Cmd(0)
+	CmdAuth        = Cmd(1)
+	CmdPush        = Cmd(2)
+	CmdHeartbeat   = Cmd(3)
+	CmdClose       = Cmd(4)
+	CmdServerPush  = Cmd(5)
+	CmdAck         = Cmd(6)
+	CmdSubscribe   = Cmd(7)
+	CmdUnsubscribe = Cmd(8)
 )
 
 const (
@@ -41,10 +36,16 @@ const (
 
 const (
 	DefaultMagicNumber = 0x08
-	DefaultHeaderLen   = 20
+	DefaultHeaderLen   = HeaderLenV1
 	MaxBodyLen         = 2 * MB
 )
 
+//headerLen 同时表示头部版本，v2 在末尾增加 code
+const (
+	HeaderLenV1 = 20
+	HeaderLenV2 = 24
+)
+
 var (
 	ErrBodyLenOverLimit = errors.New("body length over limit")
 	ErrWrongBodyLen     = errors.New("wrong body length")
@@ -57,7 +58,8 @@ var (
 //cmd         Cmd
 //requestId   uint32 请求id由客户端设置
 //bodyLen     uint32
-type header [DefaultHeaderLen]byte
+//code        uint32 仅v2，状态码
+type header [HeaderLenV2]byte
 
 type Message struct {
 	header
@@ -85,12 +87,13 @@ func NewDefaultMessage() Interface.Message {
 
 func (m *Message) HeaderString() string {
 	return fmt.Sprintf(
-		`"magicNumber":%v, "headerLen":%v, "cmd":%v, "requestId":%v, bodyLen":%v`,
+		`"magicNumber":%v, "headerLen":%v, "cmd":%v, "requestId":%v, bodyLen":%v, "code":%v`,
 		m.MagicNumber(),
 		m.HeaderLen(),
 		m.Cmd(),
 		m.RequestId(),
 		m.BodyLen(),
+		m.Code(),
 	)
 }
 
@@ -118,6 +121,12 @@ func (m *Message) setBodyLen(n uint32) {
 	binary.BigEndian.PutUint32(m.header[16:20], n)
 }
 
+//code 不为0时以v2头部编码
+func (m *Message) SetCode(code uint32) Interface.Message {
+	binary.BigEndian.PutUint32(m.header[20:24], code)
+	return m
+}
+
 func (m *Message) MagicNumber() uint32 {
 	return binary.BigEndian.Uint32(m.header[0:4])
 }
@@ -138,6 +147,23 @@ func (m *Message) BodyLen() uint32 {
 	return binary.BigEndian.Uint32(m.header[16:20])
 }
 
+func (m *Message) Code() uint32 {
+	return binary.BigEndian.Uint32(m.header[20:24])
+}
+
+//读到的消息是否使用v2头部，对方能否解析 code
+func (m *Message) SupportsCode() bool {
+	return m.HeaderLen() == HeaderLenV2
+}
+
+//编码时的头部长度，headerLen 为v2或 code 不为0时使用v2
+func (m *Message) encodedHeaderLen() uint32 {
+	if m.HeaderLen() == HeaderLenV2 || m.Code() != 0 {
+		return HeaderLenV2
+	}
+	return HeaderLenV1
+}
+
 func (m *Message) String() string {
 	return fmt.Sprintf(
 		`%v, "body":%s`,
@@ -157,7 +183,7 @@ func (m *Message) Body() []byte {
 }
 
 func (m *Message) ReadFrom(r io.Reader) (int64, error) {
-	header := m.header[:]
+	header := m.header[:HeaderLenV1]
 
 	if c, ok := r.(transport.BlockConn); ok {
 		data, err := c.ReadBlock()
@@ -178,6 +204,14 @@ func (m *Message) ReadFrom(r io.Reader) (int64, error) {
 		return int64(n), err
 	}
 
+	if m.HeaderLen() == HeaderLenV2 {
+		if n, err := io.ReadFull(r, m.header[HeaderLenV1:]); err != nil {
+			return int64(HeaderLenV1 + n), err
+		}
+	} else {
+		m.SetCode(0)
+	}
+
 	//一个小优化
 	body := m.body
 	bodyLen := int(m.BodyLen())
@@ -209,7 +243,7 @@ func (m *Message) validHeader() error {
 	}
 
 	//检查header长度
-	if m.HeaderLen() != DefaultHeaderLen {
+	if hl := m.HeaderLen(); hl != HeaderLenV1 && hl != HeaderLenV2 {
 		return ErrWrongHeaderLen
 	}
 
@@ -232,10 +266,12 @@ func (m *Message) Decode(r io.Reader) error {
 }
 
 func (m *Message) Encode() []byte {
-	data := make([]byte, DefaultHeaderLen+m.BodyLen())
+	headerLen := m.encodedHeaderLen()
+	data := make([]byte, headerLen+m.BodyLen())
 
-	copy(data[:DefaultHeaderLen], m.header[:])
-	copy(data[DefaultHeaderLen:], m.body)
+	copy(data[:headerLen], m.header[:])
+	binary.BigEndian.PutUint32(data[4:8], headerLen)
+	copy(data[headerLen:], m.body)
 	return data
 }
 
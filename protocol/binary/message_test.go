@@ -0,0 +1,54 @@
+package binary
+
+import (
+	"bytes"
+	"github.com/kuhufu/cm/protocol/consts"
+	"testing"
+)
+
+func TestMessage_HeaderVersion(t *testing.T) {
+	//code 为0时按v1编码，旧版本可以解析
+	msg := NewDefaultMessage().SetCmd(consts.CmdPush).SetRequestId(7).SetBody([]byte("hello"))
+	data := msg.Encode()
+	if len(data) != HeaderLenV1+5 {
+		t.Fatalf("wrong length: %v", len(data))
+	}
+
+	got := newMessage()
+	if _, err := got.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if got.SupportsCode() || got.Code() != 0 || got.RequestId() != 7 || string(got.Body()) != "hello" {
+		t.Errorf("wrong message: %v", got)
+	}
+
+	msg.SetCode(consts.CodeTooManyRequests)
+	data = msg.Encode()
+	if len(data) != HeaderLenV2+5 {
+		t.Fatalf("wrong length: %v", len(data))
+	}
+
+	if _, err := got.ReadFrom(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if !got.SupportsCode() || got.Code() != consts.CodeTooManyRequests || string(got.Body()) != "hello" {
+		t.Errorf("wrong message: %v", got)
+	}
+
+	//复用的消息读到v1头部时清除 code
+	if _, err := got.ReadFrom(bytes.NewReader(NewDefaultMessage().Encode())); err != nil {
+		t.Fatal(err)
+	}
+	if got.Code() != 0 {
+		t.Errorf("code not reset: %v", got.Code())
+	}
+}
+
+func TestMessage_WrongHeaderLen(t *testing.T) {
+	data := NewDefaultMessage().Encode()
+	data[7] = 22
+
+	if _, err := newMessage().ReadFrom(bytes.NewReader(data)); err != ErrWrongHeaderLen {
+		t.Errorf("wrong error: %v", err)
+	}
+}
@@ -17,5 +17,9 @@ func GetPoolMsg() Interface.Message {
 }
 
 func FreePoolMsg(msg Interface.Message) {
+	msg.SetCode(0)
+	if m, ok := msg.(*Message); ok {
+		m.SetHeaderLen(DefaultHeaderLen)
+	}
 	pool.Put(msg)
 }
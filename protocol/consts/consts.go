@@ -1,12 +1,32 @@
 package consts
 
 const (
-	CmdUnknown    = 0
-	CmdAuth       = 1
-	CmdPush       = 2
-	CmdHeartbeat  = 3
-	CmdClose      = 4
-	CmdServerPush = 5
+	CmdUnknown     = 0
+	CmdAuth        = 1
+	CmdPush        = 2
+	CmdHeartbeat   = 3
+	CmdClose       = 4
+	CmdServerPush  = 5
+	CmdAck         = 6 //可靠推送的确认，RequestId 为推送的序号
+	CmdSubscribe   = 7 //订阅主题，body 为主题名
+	CmdUnsubscribe = 8 //取消订阅主题，body 为主题名
+
+	CmdCustomStart = 64 //自定义命令的起始值，小于它的保留给内置命令
+)
+
+//状态码，0表示成功，应用自定义的状态码从 CodeCustomStart 开始
+const (
+	CodeOk              = 0
+	CodeUnknown         = 1 //未分类的错误
+	CodeBadRequest      = 2
+	CodeUnauthorized    = 3 //认证失败
+	CodeForbidden       = 4
+	CodeNotFound        = 5
+	CodeTooManyRequests = 6
+	CodeServerBusy      = 7
+	CodeInternal        = 8
+
+	CodeCustomStart = 1000
 )
 
 const (
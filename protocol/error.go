@@ -0,0 +1,20 @@
+package protocol
+
+import "fmt"
+
+//带状态码的错误，服务端以 Code 和 Message 回复，客户端解码为该类型
+type Error struct {
+	Code    uint32
+	Message string
+}
+
+func NewError(code uint32, message string) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+	}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("code: %v, %v", e.Code, e.Message)
+}
@@ -30,6 +30,13 @@ var (
 
 type MessageV1 struct {
 	Message
+	code uint32
+}
+
+//线上格式，code 不在 message.proto 中，为0时省略，旧版本解析时会忽略
+type wireMessage struct {
+	*Message
+	Code uint32 `json:"code,omitempty"`
 }
 
 func NewMessage() Interface.Message {
@@ -85,7 +92,9 @@ func (m *MessageV1) ReadFrom(r io.Reader) (int64, error) {
 		return 0, err
 	}
 
-	err = json.Unmarshal(data, &m.Message)
+	wire := wireMessage{Message: &m.Message}
+	err = json.Unmarshal(data, &wire)
+	m.code = wire.Code
 
 	if err := m.valid(); err != nil {
 		return 0, err
@@ -104,7 +113,7 @@ func (m *MessageV1) WriteTo(w io.Writer) (int64, error) {
 		n   int
 	)
 
-	marshal, err := json.Marshal(&m.Message)
+	marshal, err := json.Marshal(m.wire())
 	if err != nil {
 		return 0, err
 	}
@@ -130,10 +139,14 @@ func (m *MessageV1) Decode(reader io.Reader) error {
 }
 
 func (m *MessageV1) Encode() []byte {
-	marshal, _ := json.Marshal(&m.Message)
+	marshal, _ := json.Marshal(m.wire())
 	return marshal
 }
 
+func (m *MessageV1) wire() *wireMessage {
+	return &wireMessage{Message: &m.Message, Code: m.code}
+}
+
 func (m *MessageV1) Size() uint32 {
 	return 0
 }
@@ -160,6 +173,15 @@ func (m *MessageV1) SetBody(body []byte) Interface.Message {
 	return m
 }
 
+func (m *MessageV1) Code() uint32 {
+	return m.code
+}
+
+func (m *MessageV1) SetCode(code uint32) Interface.Message {
+	m.code = code
+	return m
+}
+
 func (m *MessageV1) SetCmd(cmd Interface.Cmd) Interface.Message {
 	m.Message.Cmd = Cmd(cmd)
 	return m
@@ -20,5 +20,6 @@ func FreePoolMsg(msg Interface.Message) {
 	if _, ok := msg.(*MessageV1); !ok {
 		panic("ddddddddddd")
 	}
+	msg.SetCode(0)
 	pool.Put(msg)
 }
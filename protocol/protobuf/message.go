@@ -0,0 +1,278 @@
+package protobuf
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/kuhufu/cm/protocol/Interface"
+	"github.com/kuhufu/cm/transport"
+	"google.golang.org/protobuf/encoding/protowire"
+	"io"
+)
+
+const (
+	KB = 1 << 10
+	MB = KB << 10
+)
+
+const (
+	DefaultMagicNumber = 0x08
+	MsgLen             = 4
+	MaxBodyLen         = 2 * MB
+)
+
+//字段编号，与 protocol/json/message.proto 保持一致
+const (
+	fieldMagicNumber = protowire.Number(1)
+	fieldCmd         = protowire.Number(2)
+	fieldRequestId   = protowire.Number(3)
+	fieldBody        = protowire.Number(4)
+	fieldCode        = protowire.Number(5) //message.proto 之外的扩展，旧版本解析时会跳过
+)
+
+var (
+	ErrBodyLenOverLimit = errors.New("body length over limit")
+	ErrWrongBodyLen     = errors.New("wrong body length")
+	ErrWrongMessage     = errors.New("wrong protobuf message")
+)
+
+//线上格式与 message.proto 中的 Message 一致，body 按 bytes 处理，不做utf8校验
+//tcp: 4字节长度(LittleEndian) + protobuf数据
+//websocket: 一个frame一条protobuf数据
+type Message struct {
+	magicNumber uint32
+	cmd         Interface.Cmd
+	requestId   uint32
+	body        []byte
+	code        uint32
+}
+
+func NewMessage() Interface.Message {
+	return &Message{}
+}
+
+func newMessage() *Message {
+	return &Message{}
+}
+
+func NewDefaultMessage() Interface.Message {
+	return &Message{
+		magicNumber: DefaultMagicNumber,
+	}
+}
+
+func (m *Message) String() string {
+	return fmt.Sprintf(
+		`"magicNumber":%v, "cmd":%v, "requestId":%v, "code":%v, "body":%s`,
+		m.magicNumber,
+		m.cmd,
+		m.requestId,
+		m.code,
+		m.body,
+	)
+}
+
+func (m *Message) MagicNumber() uint32 {
+	return m.magicNumber
+}
+
+func (m *Message) Cmd() Interface.Cmd {
+	return m.cmd
+}
+
+func (m *Message) Body() []byte {
+	return m.body
+}
+
+func (m *Message) RequestId() uint32 {
+	return m.requestId
+}
+
+func (m *Message) Code() uint32 {
+	return m.code
+}
+
+func (m *Message) SetCode(code uint32) Interface.Message {
+	m.code = code
+	return m
+}
+
+func (m *Message) SetMagicNumber(n uint32) Interface.Message {
+	m.magicNumber = n
+	return m
+}
+
+func (m *Message) SetCmd(cmd Interface.Cmd) Interface.Message {
+	m.cmd = cmd
+	return m
+}
+
+func (m *Message) SetBody(body []byte) Interface.Message {
+	m.body = body
+	return m
+}
+
+func (m *Message) SetRequestId(id uint32) Interface.Message {
+	m.requestId = id
+	return m
+}
+
+func (m *Message) ReadFrom(r io.Reader) (int64, error) {
+	var data []byte
+	var err error
+
+	switch r := r.(type) {
+	case transport.BlockConn:
+		data, err = r.ReadBlock()
+	default:
+		msgLenBytes := make([]byte, MsgLen)
+		n, err := io.ReadFull(r, msgLenBytes)
+		if err != nil {
+			return int64(n), err
+		}
+
+		msgLen := binary.LittleEndian.Uint32(msgLenBytes)
+		if msgLen > MaxBodyLen {
+			return int64(n), ErrBodyLenOverLimit
+		}
+
+		data = make([]byte, msgLen)
+		if n, err := io.ReadFull(r, data); err != nil {
+			return int64(MsgLen + n), ErrWrongBodyLen
+		}
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	if err := m.Unmarshal(data); err != nil {
+		return 0, err
+	}
+
+	return int64(len(data)), nil
+}
+
+func (m *Message) WriteTo(w io.Writer) (int64, error) {
+	n, err := WriteEncoded(w, m.Encode())
+	return int64(n), err
+}
+
+//按连接类型写入 Encode 得到的数据，tcp连接需要加上长度前缀
+func WriteEncoded(w io.Writer, data []byte) (int, error) {
+	if _, ok := w.(transport.BlockConn); ok {
+		return w.Write(data)
+	}
+
+	lenAndMsgBytes := make([]byte, MsgLen+len(data))
+	binary.LittleEndian.PutUint32(lenAndMsgBytes, uint32(len(data)))
+	copy(lenAndMsgBytes[MsgLen:], data)
+
+	return w.Write(lenAndMsgBytes)
+}
+
+func (m *Message) Decode(r io.Reader) error {
+	_, err := m.ReadFrom(r)
+	return err
+}
+
+//不包含长度前缀
+func (m *Message) Encode() []byte {
+	//4个uint32字段，每个最多 1字节tag + 5字节varint
+	size := 4*6 + protowire.SizeTag(fieldBody) + protowire.SizeBytes(len(m.body))
+	data := make([]byte, 0, size)
+
+	if m.magicNumber != 0 {
+		data = protowire.AppendTag(data, fieldMagicNumber, protowire.VarintType)
+		data = protowire.AppendVarint(data, uint64(m.magicNumber))
+	}
+	if m.cmd != 0 {
+		data = protowire.AppendTag(data, fieldCmd, protowire.VarintType)
+		data = protowire.AppendVarint(data, uint64(m.cmd))
+	}
+	if m.requestId != 0 {
+		data = protowire.AppendTag(data, fieldRequestId, protowire.VarintType)
+		data = protowire.AppendVarint(data, uint64(m.requestId))
+	}
+	if len(m.body) != 0 {
+		data = protowire.AppendTag(data, fieldBody, protowire.BytesType)
+		data = protowire.AppendBytes(data, m.body)
+	}
+	if m.code != 0 {
+		data = protowire.AppendTag(data, fieldCode, protowire.VarintType)
+		data = protowire.AppendVarint(data, uint64(m.code))
+	}
+
+	return data
+}
+
+func (m *Message) Unmarshal(data []byte) error {
+	body := m.body[:0]
+	m.magicNumber = 0
+	m.cmd = 0
+	m.requestId = 0
+	m.code = 0
+	m.body = nil
+
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return ErrWrongMessage
+		}
+		data = data[n:]
+
+		switch {
+		case num == fieldMagicNumber && typ == protowire.VarintType,
+			num == fieldCmd && typ == protowire.VarintType,
+			num == fieldRequestId && typ == protowire.VarintType,
+			num == fieldCode && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(data)
+			if n < 0 {
+				return ErrWrongMessage
+			}
+			data = data[n:]
+
+			switch num {
+			case fieldMagicNumber:
+				m.magicNumber = uint32(v)
+			case fieldCmd:
+				m.cmd = Interface.Cmd(v)
+			case fieldRequestId:
+				m.requestId = uint32(v)
+			case fieldCode:
+				m.code = uint32(v)
+			}
+		case num == fieldBody && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(data)
+			if n < 0 {
+				return ErrWrongMessage
+			}
+			if len(v) > MaxBodyLen {
+				return ErrBodyLenOverLimit
+			}
+			data = data[n:]
+
+			//data可能被复用，这里拷贝一份
+			m.body = append(body, v...)
+		default: //跳过未知字段
+			n := protowire.ConsumeFieldValue(num, typ, data)
+			if n < 0 {
+				return ErrWrongMessage
+			}
+			data = data[n:]
+		}
+	}
+
+	return nil
+}
+
+func Read(r io.Reader) (*Message, error) {
+	message := newMessage()
+
+	err := message.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
@@ -0,0 +1,79 @@
+package protobuf
+
+import (
+	"bytes"
+	"github.com/kuhufu/cm/protocol/consts"
+	"testing"
+)
+
+func TestMessage_ReadFromWriteTo(t *testing.T) {
+	msg := NewDefaultMessage()
+	msg.SetCmd(consts.CmdPush).SetRequestId(7).SetBody([]byte{0xff, 0x00, 'a'})
+
+	buf := &bytes.Buffer{}
+	if _, err := msg.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got := newMessage()
+	if _, err := got.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.MagicNumber() != DefaultMagicNumber || got.Cmd() != consts.CmdPush || got.RequestId() != 7 {
+		t.Errorf("wrong header: %v", got)
+	}
+
+	if !bytes.Equal(got.Body(), []byte{0xff, 0x00, 'a'}) {
+		t.Errorf("wrong body: %v", got.Body())
+	}
+}
+
+func TestMessage_Encode(t *testing.T) {
+	msg := NewMessage().SetCmd(consts.CmdServerPush).SetBody([]byte("hello"))
+
+	got := newMessage()
+	if err := got.Unmarshal(msg.Encode()); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.Cmd() != consts.CmdServerPush || string(got.Body()) != "hello" {
+		t.Errorf("wrong message: %v", got)
+	}
+}
+
+func TestMessage_Code(t *testing.T) {
+	msg := NewDefaultMessage().SetCmd(consts.CmdPush).SetCode(consts.CodeForbidden).SetBody([]byte("forbidden"))
+
+	got := newMessage()
+	if err := got.Unmarshal(msg.Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if got.Code() != consts.CodeForbidden || string(got.Body()) != "forbidden" {
+		t.Errorf("wrong message: %v", got)
+	}
+
+	//复用时清除上一条消息的 code
+	if err := got.Unmarshal(NewDefaultMessage().Encode()); err != nil {
+		t.Fatal(err)
+	}
+	if got.Code() != 0 {
+		t.Errorf("code not reset: %v", got.Code())
+	}
+}
+
+//不是 BlockConn 的 reader 都按长度前缀读取
+func TestMessage_ReadFromBytesReader(t *testing.T) {
+	buf := &bytes.Buffer{}
+	if _, err := NewDefaultMessage().SetCmd(consts.CmdPush).SetBody([]byte("a")).WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+
+	got := newMessage()
+	if _, err := got.ReadFrom(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if got.Cmd() != consts.CmdPush || string(got.Body()) != "a" {
+		t.Errorf("wrong message: %v", got)
+	}
+}
@@ -4,6 +4,8 @@ import (
 	"github.com/kuhufu/cm/protocol/Interface"
 	"github.com/kuhufu/cm/protocol/binary"
 	"github.com/kuhufu/cm/protocol/json"
+	"github.com/kuhufu/cm/protocol/protobuf"
+	"io"
 )
 
 type MsgProto int
@@ -16,10 +18,14 @@ const (
 )
 
 type MsgProtoFactory struct {
+	//自定义协议为NONE
+	Proto             MsgProto
 	NewMessage        func() Interface.Message
 	NewDefaultMessage func() Interface.Message
 	GetPoolMsg        func() Interface.Message
 	FreePoolMsg       func(msg Interface.Message)
+	//写入Encode得到的数据，为nil时直接写入
+	WriteEncoded func(w io.Writer, data []byte) (int, error)
 }
 
 func GetFactory(msgProto MsgProto) *MsgProtoFactory {
@@ -27,6 +33,7 @@ func GetFactory(msgProto MsgProto) *MsgProtoFactory {
 	switch msgProto {
 	case BINARY:
 		factory = &MsgProtoFactory{
+			Proto:             BINARY,
 			NewMessage:        binary.NewMessage,
 			NewDefaultMessage: binary.NewDefaultMessage,
 			GetPoolMsg:        binary.GetPoolMsg,
@@ -34,13 +41,21 @@ func GetFactory(msgProto MsgProto) *MsgProtoFactory {
 		}
 	case JSON:
 		factory = &MsgProtoFactory{
+			Proto:             JSON,
 			NewMessage:        json.NewMessage,
 			NewDefaultMessage: json.NewDefaultMessage,
 			GetPoolMsg:        json.GetPoolMsg,
 			FreePoolMsg:       json.FreePoolMsg,
 		}
 	case PROTOBUF:
-		panic("unsupported")
+		factory = &MsgProtoFactory{
+			Proto:             PROTOBUF,
+			NewMessage:        protobuf.NewMessage,
+			NewDefaultMessage: protobuf.NewDefaultMessage,
+			GetPoolMsg:        protobuf.GetPoolMsg,
+			FreePoolMsg:       protobuf.FreePoolMsg,
+			WriteEncoded:      protobuf.WriteEncoded,
+		}
 	}
 
 	return factory
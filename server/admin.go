@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+//管理接口最多读取的推送数据
+const maxAdminBodyLen = 2 << 20
+
+//管理接口中的房间
+type RoomInfo struct {
+	Id   string `json:"id"`
+	Size int    `json:"size"`
+}
+
+//管理接口中的连接
+type ChannelInfo struct {
+	Id         string    `json:"id"`
+	RoomId     string    `json:"roomId"`
+	Network    string    `json:"network"`
+	RemoteAddr string    `json:"remoteAddr"`
+	CreateTime time.Time `json:"createTime"`
+	QueueLen   int       `json:"queueLen"` //发送队列中待发送的消息数
+	Metadata   []string  `json:"metadata"` //Metadata 的key
+}
+
+//管理接口，不做鉴权，需要自行包装或只在内网监听，挂载在子路径时使用 http.StripPrefix
+//GET /rooms: 房间列表
+//GET /rooms/{roomId}: 房间内的连接
+//POST /rooms/{roomId}/kick: 踢掉房间内所有连接，参数 reason 为发送给客户端的原因
+//POST /rooms/{roomId}/channels/{id}/kick: 踢掉一个连接，参数同上
+//POST /rooms/{roomId}/push: 推送给房间，body为推送数据
+//POST /broadcast: 推送给所有连接，body为推送数据
+func (srv *Server) AdminHandler() http.Handler {
+	return http.HandlerFunc(srv.serveAdmin)
+}
+
+func (srv *Server) serveAdmin(w http.ResponseWriter, r *http.Request) {
+	path, err := splitAdminPath(r.URL.EscapedPath())
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch {
+	case len(path) == 1 && path[0] == "rooms":
+		if adminMethod(w, r, http.MethodGet) {
+			writeAdminJSON(w, srv.roomInfos())
+		}
+	case len(path) == 2 && path[0] == "rooms":
+		if adminMethod(w, r, http.MethodGet) {
+			srv.adminListChannels(w, path[1])
+		}
+	case len(path) == 3 && path[0] == "rooms" && path[2] == "kick":
+		if adminMethod(w, r, http.MethodPost) {
+			srv.adminKickRoom(w, path[1], r.FormValue("reason"))
+		}
+	case len(path) == 5 && path[0] == "rooms" && path[2] == "channels" && path[4] == "kick":
+		if adminMethod(w, r, http.MethodPost) {
+			srv.adminKickChannel(w, path[1], path[3], r.FormValue("reason"))
+		}
+	case len(path) == 3 && path[0] == "rooms" && path[2] == "push":
+		if adminMethod(w, r, http.MethodPost) {
+			srv.adminPush(w, r, path[1])
+		}
+	case len(path) == 1 && path[0] == "broadcast":
+		if adminMethod(w, r, http.MethodPost) {
+			srv.adminPush(w, r, "")
+		}
+	default:
+		writeAdminError(w, http.StatusNotFound, fmt.Errorf("%v not found", r.URL.Path))
+	}
+}
+
+func (srv *Server) roomInfos() []RoomInfo {
+	rooms := []RoomInfo{}
+	srv.cm.Range(func(id string, room *Room) bool {
+		rooms = append(rooms, RoomInfo{Id: id, Size: room.Size()})
+		return true
+	})
+
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Id < rooms[j].Id
+	})
+	return rooms
+}
+
+func (srv *Server) adminListChannels(w http.ResponseWriter, roomId string) {
+	room, ok := srv.cm.Get(roomId)
+	if !ok {
+		writeAdminError(w, http.StatusNotFound, ErrRoomNotExist)
+		return
+	}
+
+	channels := []ChannelInfo{}
+	room.Range(func(id string, channel *Channel) bool {
+		channels = append(channels, channel.info())
+		return true
+	})
+
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Id < channels[j].Id
+	})
+	writeAdminJSON(w, channels)
+}
+
+func (srv *Server) adminKickRoom(w http.ResponseWriter, roomId string, reason string) {
+	if !srv.cm.Exist(roomId) {
+		writeAdminError(w, http.StatusNotFound, ErrRoomNotExist)
+		return
+	}
+
+	n := srv.KickRoom(roomId, []byte(reason))
+	writeAdminJSON(w, map[string]int{"kicked": n})
+}
+
+func (srv *Server) adminKickChannel(w http.ResponseWriter, roomId string, channelId string, reason string) {
+	if err := srv.Kick(roomId, channelId, []byte(reason)); err != nil {
+		writeAdminError(w, http.StatusNotFound, err)
+		return
+	}
+	writeAdminJSON(w, map[string]int{"kicked": 1})
+}
+
+//roomId 为空时广播
+func (srv *Server) adminPush(w http.ResponseWriter, r *http.Request, roomId string) {
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAdminBodyLen))
+	if err != nil {
+		writeAdminError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	var report DeliveryReport
+	if roomId == "" {
+		report = srv.BroadcastContext(r.Context(), data)
+	} else {
+		report = srv.UnicastContext(r.Context(), data, roomId)
+	}
+	writeAdminJSON(w, report)
+}
+
+func (c *Channel) info() ChannelInfo {
+	info := ChannelInfo{
+		Id:         c.Id(),
+		RoomId:     c.RoomId(),
+		Network:    c.Network,
+		RemoteAddr: c.RemoteAddr().String(),
+		CreateTime: c.CreateTime,
+		QueueLen:   c.QueueLen(),
+		Metadata:   []string{},
+	}
+
+	c.Metadata.Range(func(key, value interface{}) bool {
+		info.Metadata = append(info.Metadata, fmt.Sprint(key))
+		return true
+	})
+	sort.Strings(info.Metadata)
+	return info
+}
+
+//按 / 分割，每一段单独解码，id中可以有转义的 /
+func splitAdminPath(escapedPath string) ([]string, error) {
+	segments := strings.Split(strings.Trim(escapedPath, "/"), "/")
+	for i, segment := range segments {
+		s, err := url.PathUnescape(segment)
+		if err != nil {
+			return nil, err
+		}
+		segments[i] = s
+	}
+	return segments, nil
+}
+
+func adminMethod(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeAdminError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %v not allowed", r.Method))
+	return false
+}
+
+func writeAdminJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAdminError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
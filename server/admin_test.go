@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/kuhufu/cm/protocol"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestServer_AdminHandler(t *testing.T) {
+	srv := NewServer(WithMsgProtocol(protocol.BINARY))
+	handler := srv.AdminHandler()
+
+	do := func(method string, path string, body string, v interface{}) int {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		if v != nil {
+			if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+				t.Fatalf("%v %v: %v", method, path, err)
+			}
+		}
+		return w.Code
+	}
+
+	var rooms []RoomInfo
+	if code := do(http.MethodGet, "/rooms", "", &rooms); code != http.StatusOK || len(rooms) != 0 {
+		t.Fatalf("wrong rooms: %v %+v", code, rooms)
+	}
+
+	for _, id := range []string{"web", "ios"} {
+		conn, peer := net.Pipe()
+		go io.Copy(ioutil.Discard, peer)
+		channel := NewChannel(conn, "pipe", srv)
+		channel.Metadata.Store("uid", 1)
+		srv.addChannel(channel, "a/1", id, srv.GetMsgFactory().GetPoolMsg())
+		go srv.writeLoop(channel)
+	}
+
+	if code := do(http.MethodGet, "/rooms", "", &rooms); code != http.StatusOK || len(rooms) != 1 || rooms[0].Size != 2 {
+		t.Fatalf("wrong rooms: %v %+v", code, rooms)
+	}
+
+	var channels []ChannelInfo
+	if code := do(http.MethodGet, "/rooms/a%2F1", "", &channels); code != http.StatusOK || len(channels) != 2 {
+		t.Fatalf("wrong channels: %v %+v", code, channels)
+	}
+	if c := channels[0]; c.Id != "ios" || c.RoomId != "a/1" || c.Network != "pipe" || len(c.Metadata) != 1 {
+		t.Errorf("wrong channel: %+v", c)
+	}
+
+	var report DeliveryReport
+	if code := do(http.MethodPost, "/rooms/a%2F1/push", "hello", &report); code != http.StatusOK || report.Enqueued != 2 {
+		t.Errorf("wrong report: %v %+v", code, report)
+	}
+	if code := do(http.MethodPost, "/broadcast", "hello", &report); code != http.StatusOK || report.Enqueued != 2 {
+		t.Errorf("wrong report: %v %+v", code, report)
+	}
+
+	if code := do(http.MethodPost, "/rooms/a%2F1/channels/web/kick", "", nil); code != http.StatusOK {
+		t.Errorf("wrong code: %v", code)
+	}
+	if code := do(http.MethodPost, "/rooms/a%2F1/channels/web/kick", "", nil); code != http.StatusNotFound {
+		t.Errorf("wrong code: %v", code)
+	}
+
+	var kicked map[string]int
+	if code := do(http.MethodPost, "/rooms/a%2F1/kick", "", &kicked); code != http.StatusOK || kicked["kicked"] != 1 {
+		t.Errorf("wrong kick: %v %v", code, kicked)
+	}
+	if srv.cm.Exist("a/1") {
+		t.Error("room should be removed")
+	}
+
+	if code := do(http.MethodDelete, "/rooms", "", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("wrong code: %v", code)
+	}
+}
@@ -0,0 +1,170 @@
+package server
+
+import (
+	logger "github.com/kuhufu/cm/logger"
+	"github.com/kuhufu/cm/protocol/Interface"
+	"sync"
+	"sync/atomic"
+)
+
+//异步处理请求的配置
+//开启后 CmdPush 和自定义命令交给 worker 处理，读goroutine不再等待，心跳不会被慢请求阻塞
+//回复仍按 RequestId 匹配，不保证与请求顺序一致，除非 Ordered 为true
+//服务关闭后已排队的请求仍会处理完，之后收到的请求回复 ErrServerClosed
+type AsyncOptions struct {
+	//worker数量，默认64
+	Workers int
+	//等待处理的请求数上限，所有连接共用，默认1024，满时回复 ErrServerBusy
+	QueueSize int
+	//同一连接的请求按顺序处理，连接固定分配给一个worker
+	Ordered bool
+	//每个连接同时处理的请求数上限，默认16，超过时回复 ErrTooManyRequests
+	MaxInFlight int
+}
+
+func (o *AsyncOptions) init() {
+	if o.Workers <= 0 {
+		o.Workers = 64
+	}
+	if o.QueueSize <= 0 {
+		o.QueueSize = 1024
+	}
+	if o.MaxInFlight <= 0 {
+		o.MaxInFlight = 16
+	}
+}
+
+type workerPool struct {
+	opts   AsyncOptions
+	queues []chan func() //Ordered 时每个worker一个队列，否则共用一个
+	next   uint32
+
+	mu      sync.RWMutex //保护 stopped，stop 后不再向队列发送
+	stopped bool
+	wg      sync.WaitGroup
+}
+
+func newWorkerPool(opts AsyncOptions) *workerPool {
+	opts.init()
+	p := &workerPool{opts: opts}
+
+	if opts.Ordered {
+		size := opts.QueueSize / opts.Workers
+		if size < 1 {
+			size = 1
+		}
+		for i := 0; i < opts.Workers; i++ {
+			p.queues = append(p.queues, make(chan func(), size))
+		}
+	} else {
+		p.queues = []chan func(){make(chan func(), opts.QueueSize)}
+	}
+	return p
+}
+
+func (p *workerPool) run() {
+	for i := 0; i < p.opts.Workers; i++ {
+		p.wg.Add(1)
+		go p.work(p.queues[i%len(p.queues)])
+	}
+}
+
+//队列关闭并处理完后退出
+func (p *workerPool) work(queue chan func()) {
+	defer p.wg.Done()
+
+	for task := range queue {
+		task()
+	}
+}
+
+//不再接收新任务，worker处理完已排队的任务后退出
+func (p *workerPool) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.stopped {
+		return
+	}
+	p.stopped = true
+	for _, queue := range p.queues {
+		close(queue)
+	}
+}
+
+//等待 stop 后所有worker退出
+func (p *workerPool) wait() {
+	p.wg.Wait()
+}
+
+//为连接分配队列，Ordered 时同一连接的请求进入同一个队列
+func (p *workerPool) shard() int {
+	return int(atomic.AddUint32(&p.next, 1) % uint32(len(p.queues)))
+}
+
+//队列满时返回 ErrServerBusy，stop 后返回 ErrServerClosed
+func (p *workerPool) submit(shard int, task func()) error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.stopped {
+		return ErrServerClosed
+	}
+
+	select {
+	case p.queues[shard] <- task:
+		return nil
+	default:
+		return ErrServerBusy
+	}
+}
+
+//连接的异步请求状态
+type asyncChannel struct {
+	shard    int
+	inflight chan struct{}
+}
+
+func (srv *Server) newAsyncChannel() *asyncChannel {
+	return &asyncChannel{
+		shard:    srv.async.shard(),
+		inflight: make(chan struct{}, srv.async.opts.MaxInFlight),
+	}
+}
+
+//msg 会被读goroutine复用，复制后交给worker
+func (srv *Server) dispatch(channel *Channel, ac *asyncChannel, msg Interface.Message, receive ReceiveInvoker) {
+	factory := channel.MsgFactory()
+
+	select {
+	case ac.inflight <- struct{}{}:
+	default:
+		channel.EnterOutMsg(buildErrorMessage(channel, msg, ErrTooManyRequests))
+		return
+	}
+
+	body := make([]byte, len(msg.Body()))
+	copy(body, msg.Body())
+	req := factory.GetPoolMsg().SetCmd(msg.Cmd()).SetRequestId(msg.RequestId()).SetBody(body)
+
+	task := func() {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Errorf("%v, handle %v panic: %v", channel, req.Cmd(), err)
+				channel.CloseWithReason(CloseInternal)
+			}
+			factory.FreePoolMsg(req)
+			<-ac.inflight
+		}()
+
+		if channel.Alive() {
+			srv.handleRequest(channel, req, receive)
+		}
+	}
+
+	if err := srv.async.submit(ac.shard, task); err != nil {
+		factory.FreePoolMsg(req)
+		<-ac.inflight
+		channel.EnterOutMsg(buildErrorMessage(channel, msg, err))
+	}
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/kuhufu/cm/client"
+	"github.com/kuhufu/cm/protocol/consts"
+	"testing"
+	"time"
+)
+
+func TestWorkerPool_Ordered(t *testing.T) {
+	pool := newWorkerPool(AsyncOptions{Workers: 4, QueueSize: 400, Ordered: true})
+	pool.run()
+	defer pool.stop()
+
+	shard := pool.shard()
+	resultC := make(chan int, 100)
+	for i := 0; i < 100; i++ {
+		i := i
+		if err := pool.submit(shard, func() { resultC <- i }); err != nil {
+			t.Fatalf("task %v rejected", i)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if got := <-resultC; got != i {
+			t.Fatalf("got %v, want %v", got, i)
+		}
+	}
+
+	//队列满时拒绝
+	block := make(chan struct{})
+	defer close(block)
+	started := make(chan struct{})
+	pool.submit(shard, func() {
+		close(started)
+		<-block
+	})
+	<-started
+	for i := 0; i <= 100; i++ {
+		if err := pool.submit(shard, func() {}); err != nil {
+			if err != ErrServerBusy {
+				t.Errorf("wrong error: %v", err)
+			}
+			return
+		}
+	}
+	t.Error("full queue should reject")
+}
+
+//body 为 slow 时等待 release
+type slowHandler struct {
+	echoHandler
+	release chan struct{}
+}
+
+func (h slowHandler) OnReceive(channel *Channel, data []byte) []byte {
+	if string(data) == "slow" {
+		<-h.release
+	}
+	return data
+}
+
+func TestAsyncReceive(t *testing.T) {
+	cases := []struct {
+		name string
+		opts AsyncOptions
+	}{
+		{"unordered", AsyncOptions{Workers: 4}},
+		{"ordered", AsyncOptions{Workers: 4, Ordered: true, MaxInFlight: 1}},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			handler := slowHandler{release: make(chan struct{})}
+			srv, addr := runServer(t, "tcp", WithHandler(handler), WithAsyncReceive(cs.opts))
+			defer srv.Close()
+
+			c := dial(t, addr, "13", client.WithHeartbeatInterval(0))
+			defer c.Close()
+
+			slowC := make(chan []byte, 1)
+			go func() {
+				reply, _ := c.Request(context.Background(), []byte("slow"))
+				slowC <- reply
+			}()
+			time.Sleep(time.Millisecond * 50)
+
+			//慢请求处理中，读goroutine不被阻塞
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			reply, err := c.Request(ctx, []byte("fast"))
+			if cs.opts.MaxInFlight == 1 {
+				var e *Error
+				if !errors.As(err, &e) || e.Code != consts.CodeTooManyRequests {
+					t.Errorf("wrong error: %v", err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if string(reply) != "fast" {
+				t.Errorf("got %s, want fast", reply)
+			}
+
+			close(handler.release)
+			if reply := <-slowC; string(reply) != "slow" {
+				t.Errorf("wrong slow reply: %s", reply)
+			}
+		})
+	}
+}
+
+func TestAsyncReceive_Shutdown(t *testing.T) {
+	handler := slowHandler{release: make(chan struct{})}
+	srv, addr := runServer(t, "tcp", WithHandler(handler), WithAsyncReceive(AsyncOptions{Workers: 1}))
+	defer srv.Close()
+
+	c := dial(t, addr, "13", client.WithHeartbeatInterval(0))
+	defer c.Close()
+
+	replyC := make(chan []byte, 2)
+	for _, body := range []string{"slow", "queued"} {
+		body := body
+		go func() {
+			reply, _ := c.Request(context.Background(), []byte(body))
+			replyC <- reply
+		}()
+		time.Sleep(time.Millisecond * 50)
+	}
+
+	doneC := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		doneC <- srv.Shutdown(ctx)
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	//关闭后收到的请求
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	var e *Error
+	if _, err := c.Request(ctx, []byte("late")); !errors.As(err, &e) || e.Code != consts.CodeServerBusy {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	//已排队的请求处理完
+	close(handler.release)
+	replies := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		replies[string(<-replyC)] = true
+	}
+	if !replies["slow"] || !replies["queued"] {
+		t.Errorf("wrong replies: %v", replies)
+	}
+	if err := <-doneC; err != nil {
+		t.Error(err)
+	}
+}
@@ -1,7 +1,10 @@
 package server
 
 import (
+	"context"
 	"fmt"
+	logger "github.com/kuhufu/cm/logger"
+	"github.com/kuhufu/cm/protocol"
 	"github.com/kuhufu/cm/protocol/Interface"
 	"net"
 	"sync"
@@ -12,57 +15,161 @@ import (
 type Channel struct {
 	net.Conn
 	srv           *Server
-	id            string
+	opts          *Options //所属监听的配置
+	idMu          sync.RWMutex
+	id            string //idMu 保护，认证时设置，其他goroutine可能同时读取
 	roomId        string
 	status        int32
 	outMsgQueue   chan Interface.Message
 	outBytesQueue chan []byte //广播使用，避免消息多次encode
+	drainC        chan Interface.Message
 	exitC         chan struct{}
 	closeOnce     sync.Once //保证连接只关闭一次
 	CreateTime    time.Time //创建时间
 	Metadata      sync.Map  //拓展信息可自由添加
 	Network       string    //用什么协议连接的
 	OnClose       func()    //close事件
+	supportsCode  bool      //客户端能否解析回复的状态码，认证时确定
+
+	topicsMu sync.Mutex
+	topics   map[string]struct{} //订阅的主题
+
+	presenceMu    sync.Mutex
+	presenceState presenceState //presenceMu 保护
+
+	writerDoneC chan struct{} //writer退出后关闭
+	closeReason int32         //CloseReason，关闭时设置
+	closeSent   int32         //已经写入 CmdClose
 }
 
 func (c *Channel) Init(roomId string, channelId string) {
+	c.idMu.Lock()
+	defer c.idMu.Unlock()
+
 	c.roomId = roomId
 	c.id = channelId
 }
 
 func NewChannel(conn net.Conn, network string, srv *Server) *Channel {
+	return newChannel(conn, network, srv, &srv.opts)
+}
+
+func newChannel(conn net.Conn, network string, srv *Server, opts *Options) *Channel {
+	queueSize := opts.OutQueueSize
+	if queueSize <= 0 {
+		queueSize = DefaultOutQueueSize
+	}
+
 	c := &Channel{
 		Conn:          conn,
 		exitC:         make(chan struct{}),
-		outMsgQueue:   make(chan Interface.Message, 4),
-		outBytesQueue: make(chan []byte, 4),
+		writerDoneC:   make(chan struct{}),
+		outMsgQueue:   make(chan Interface.Message, queueSize),
+		outBytesQueue: make(chan []byte, queueSize),
+		drainC:        make(chan Interface.Message, 1),
 		CreateTime:    time.Now(),
 		Network:       network,
 		srv:           srv,
+		opts:          opts,
 	}
 
 	return c
 }
 
 func (c *Channel) Close() error {
+	return c.CloseWithReason(CloseUnknown)
+}
+
+//以reason关闭连接，连接已经关闭时reason不生效
+func (c *Channel) CloseWithReason(reason CloseReason) error {
+	return c.close(reason, nil)
+}
+
+//closeBody 不为nil时总是先发送以它为body的 CmdClose
+//需要发送 CmdClose 时在新的goroutine中等writer退出后发送并关闭连接，不阻塞调用方，此时返回nil
+func (c *Channel) close(reason CloseReason, closeBody []byte) error {
 	var err error
 	c.closeOnce.Do(func() {
+		atomic.StoreInt32(&c.closeReason, int32(reason))
+		atomic.AddUint64(&c.srv.closeStats[reason], 1)
 		close(c.exitC)
 
 		if c.OnClose != nil {
 			c.OnClose()
 		}
 
+		if body := c.closeNotifyBody(reason, closeBody); body != nil {
+			go func() {
+				c.notifyClose(body)
+				c.Conn.Close()
+				c.Empty()
+			}()
+			return
+		}
+
 		err = c.Conn.Close()
 		c.Empty()
 	})
 	return err
 }
 
+//关闭原因，连接未关闭时为 CloseUnknown
+func (c *Channel) CloseReason() CloseReason {
+	return CloseReason(atomic.LoadInt32(&c.closeReason))
+}
+
+//CmdClose 的body，不需要发送时为nil
+//closeBody 为nil时，开启 SendCloseReason 才以关闭原因作为body
+func (c *Channel) closeNotifyBody(reason CloseReason, closeBody []byte) []byte {
+	if c.Id() == "" {
+		return nil
+	}
+	if closeBody != nil {
+		return closeBody
+	}
+	if !c.opts.SendCloseReason || !reason.notify() {
+		return nil
+	}
+	return []byte(reason.String())
+}
+
+//等writer退出后写入以body为body的 CmdClose
+func (c *Channel) notifyClose(body []byte) {
+	timer := time.NewTimer(closeNotifyTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-c.writerDoneC:
+	case <-timer.C: //writer阻塞在写
+		return
+	}
+
+	if !atomic.CompareAndSwapInt32(&c.closeSent, 0, 1) {
+		return
+	}
+
+	msg := buildCloseMessage(c.MsgFactory(), body)
+	defer c.MsgFactory().FreePoolMsg(msg)
+
+	c.Conn.SetWriteDeadline(time.Now().Add(closeNotifyTimeout))
+	if _, err := msg.WriteTo(c.Conn); err != nil {
+		logger.Debugf("%v, write close reason error: %v", c, err)
+	}
+}
+
 func (c *Channel) Exit() <-chan struct{} {
 	return c.exitC
 }
 
+func (c *Channel) Alive() bool {
+	select {
+	case <-c.exitC:
+		return false
+	default:
+		return true
+	}
+}
+
 func (c *Channel) EnterOutMsg(msg Interface.Message) {
 	select {
 	case <-c.exitC:
@@ -71,14 +178,139 @@ func (c *Channel) EnterOutMsg(msg Interface.Message) {
 	}
 }
 
+//队列满时按 Options.OverflowPolicy 处理
 func (c *Channel) EnterOutBytes(data []byte) {
+	c.EnterOutBytesContext(context.Background(), data)
+}
+
+//进入发送队列失败时返回 ErrChannelClosed 或 ctx.Err()，msg会被回收
+func (c *Channel) EnterOutMsgContext(ctx context.Context, msg Interface.Message) error {
+	if !c.Alive() {
+		c.MsgFactory().FreePoolMsg(msg)
+		return ErrChannelClosed
+	}
+
 	select {
 	case <-c.exitC:
-		return
+		c.MsgFactory().FreePoolMsg(msg)
+		return ErrChannelClosed
+	case <-ctx.Done():
+		c.MsgFactory().FreePoolMsg(msg)
+		return ctx.Err()
+	case c.outMsgQueue <- msg:
+		return nil
+	}
+}
+
+//队列满时按 Options.OverflowPolicy 处理，消息被丢弃时返回 ErrQueueFull
+func (c *Channel) EnterOutBytesContext(ctx context.Context, data []byte) error {
+	if !c.Alive() {
+		return ErrChannelClosed
+	}
+
+	select {
 	case c.outBytesQueue <- data:
+		return nil
+	default:
+	}
+
+	stats := &c.srv.overflowStats
+
+	switch c.opts.OverflowPolicy {
+	case OverflowDropNewest:
+		atomic.AddUint64(&stats.DroppedNewest, 1)
+		return ErrQueueFull
+	case OverflowDropOldest:
+		atomic.AddUint64(&stats.DroppedOldest, 1)
+		for {
+			select {
+			case c.outBytesQueue <- data:
+				return nil
+			default:
+			}
+
+			select {
+			case <-c.outBytesQueue:
+			default:
+			}
+		}
+	case OverflowDisconnect:
+		atomic.AddUint64(&stats.Disconnected, 1)
+		logger.Printf("%v, out queue full, disconnect", c)
+		c.CloseWithReason(CloseQueueFull)
+		return ErrQueueFull
+	}
+
+	atomic.AddUint64(&stats.Blocked, 1)
+
+	var timeoutC <-chan time.Time
+	if timeout := c.opts.OverflowBlockTimeout; timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+
+	select {
+	case <-c.exitC:
+		return ErrChannelClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timeoutC:
+		atomic.AddUint64(&stats.BlockTimeouts, 1)
+		return ErrQueueFull
+	case c.outBytesQueue <- data:
+		return nil
+	}
+}
+
+//不使用 OverflowPolicy，一直等待到进入队列、连接关闭或ctx结束
+func (c *Channel) enterOutBytesWait(ctx context.Context, data []byte) error {
+	if !c.Alive() {
+		return ErrChannelClosed
+	}
+
+	select {
+	case <-c.exitC:
+		return ErrChannelClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	case c.outBytesQueue <- data:
+		return nil
+	}
+}
+
+//不使用 OverflowPolicy，队列满时直接返回 ErrQueueFull
+func (c *Channel) tryEnterOutBytes(data []byte) error {
+	if !c.Alive() {
+		return ErrChannelClosed
+	}
+
+	select {
+	case c.outBytesQueue <- data:
+		return nil
+	default:
+		return ErrQueueFull
 	}
 }
 
+//发送队列中待发送的消息数
+func (c *Channel) QueueLen() int {
+	return len(c.outMsgQueue) + len(c.outBytesQueue)
+}
+
+//通知writer写完队列中的消息和closeMsg后关闭连接
+func (c *Channel) Drain(closeMsg Interface.Message) {
+	select {
+	case c.drainC <- closeMsg:
+	default: //已经在drain
+		c.MsgFactory().FreePoolMsg(closeMsg)
+	}
+}
+
+func (c *Channel) WaitDrain() <-chan Interface.Message {
+	return c.drainC
+}
+
 func (c *Channel) WaitOutMsg() <-chan Interface.Message {
 	return c.outMsgQueue
 }
@@ -92,7 +324,7 @@ func (c *Channel) Empty() {
 	for {
 		select {
 		case msg := <-c.outMsgQueue:
-			c.srv.GetMsgFactory().FreePoolMsg(msg)
+			c.MsgFactory().FreePoolMsg(msg)
 		case <-c.outBytesQueue:
 
 		default:
@@ -108,13 +340,51 @@ func (c *Channel) StatusOk() bool {
 }
 
 func (c *Channel) String() string {
-	return fmt.Sprintf("room: %v, channel_id: %v", c.roomId, c.id)
+	return fmt.Sprintf("room: %v, channel_id: %v", c.RoomId(), c.Id())
 }
 
 func (c *Channel) Id() string {
+	c.idMu.RLock()
+	defer c.idMu.RUnlock()
 	return c.id
 }
 
 func (c *Channel) RoomId() string {
+	c.idMu.RLock()
+	defer c.idMu.RUnlock()
 	return c.roomId
 }
+
+//订阅的主题
+func (c *Channel) Topics() []string {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+
+	topics := make([]string, 0, len(c.topics))
+	for topic := range c.topics {
+		topics = append(topics, topic)
+	}
+	return topics
+}
+
+func (c *Channel) addTopic(topic string) {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+
+	if c.topics == nil {
+		c.topics = map[string]struct{}{}
+	}
+	c.topics[topic] = struct{}{}
+}
+
+func (c *Channel) delTopic(topic string) {
+	c.topicsMu.Lock()
+	defer c.topicsMu.Unlock()
+
+	delete(c.topics, topic)
+}
+
+//连接所属监听使用的消息协议
+func (c *Channel) MsgFactory() *protocol.MsgProtoFactory {
+	return c.opts.MsgFactory
+}
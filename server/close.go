@@ -0,0 +1,80 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+//连接关闭的原因
+type CloseReason int32
+
+const (
+	CloseUnknown          CloseReason = iota //直接调用 Channel.Close
+	CloseClient                              //客户端发送 CmdClose 或断开连接
+	CloseAuthTimeout                         //认证超时
+	CloseHeartbeatTimeout                    //心跳超时
+	CloseProtocolError                       //未认证时发送其他命令、未知命令
+	CloseReadError
+	CloseWriteError
+	CloseQueueFull //发送队列满，OverflowDisconnect
+	CloseReplaced  //相同 ChannelId 的新连接认证成功
+	CloseRejected  //ConnectHandler 拒绝
+	CloseKicked    //服务端踢下线
+	CloseShutdown  //服务关闭
+	CloseInternal  //处理请求时panic
+	CloseEvicted   //被 LoginPolicy 踢掉，相同 ChannelId 的替换为 CloseReplaced
+
+	closeReasonCount
+)
+
+var closeReasonMap = map[CloseReason]string{
+	CloseUnknown:          "unknown",
+	CloseClient:           "client",
+	CloseAuthTimeout:      "auth_timeout",
+	CloseHeartbeatTimeout: "heartbeat_timeout",
+	CloseProtocolError:    "protocol_error",
+	CloseReadError:        "read_error",
+	CloseWriteError:       "write_error",
+	CloseQueueFull:        "queue_full",
+	CloseReplaced:         "replaced",
+	CloseRejected:         "rejected",
+	CloseKicked:           "kicked",
+	CloseShutdown:         "shutdown",
+	CloseInternal:         "internal",
+	CloseEvicted:          "evicted",
+}
+
+func (r CloseReason) String() string {
+	return closeReasonMap[r]
+}
+
+//连接还能写时由服务端主动关闭的原因，开启 SendCloseReason 时发送给客户端
+func (r CloseReason) notify() bool {
+	switch r {
+	case CloseHeartbeatTimeout, CloseProtocolError, CloseQueueFull, CloseReplaced, CloseKicked, CloseShutdown, CloseInternal, CloseEvicted:
+		return true
+	}
+	return false
+}
+
+//等待writer退出和写入 CmdClose 的最长时间
+const closeNotifyTimeout = time.Second
+
+//读出错时的关闭原因，对方关闭连接时为 CloseClient
+func readCloseReason(err error) CloseReason {
+	if errors.Is(err, io.EOF) {
+		return CloseClient
+	}
+	return CloseReadError
+}
+
+//各关闭原因的次数，包括未认证的连接
+func (srv *Server) CloseStats() map[CloseReason]uint64 {
+	stats := make(map[CloseReason]uint64, closeReasonCount)
+	for reason := CloseReason(0); reason < closeReasonCount; reason++ {
+		stats[reason] = atomic.LoadUint64(&srv.closeStats[reason])
+	}
+	return stats
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"errors"
+	"github.com/kuhufu/cm/client"
+	"github.com/kuhufu/cm/protocol"
+	"github.com/kuhufu/cm/protocol/consts"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCloseReason(t *testing.T) {
+	srv, addr := runServer(t, "tcp", WithSendCloseReason(true))
+	defer srv.Close()
+
+	c1 := dial(t, addr, "16")
+	defer c1.Close()
+
+	c2 := dial(t, addr, "16")
+	defer c2.Close()
+
+	select {
+	case <-c1.Exit():
+		if err := c1.Err(); !errors.Is(err, client.ErrClosed) || !strings.Contains(err.Error(), CloseReplaced.String()) {
+			t.Errorf("wrong error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("replaced client not closed")
+	}
+
+	if n := srv.CloseStats()[CloseReplaced]; n != 1 {
+		t.Errorf("wrong replaced count: %v", n)
+	}
+}
+
+func TestCloseNotify_NonBlocking(t *testing.T) {
+	srv := NewServer(WithMsgProtocol(protocol.BINARY))
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	channel := newChannel(conn, "tcp", srv, &srv.opts)
+	channel.Init("17", "web")
+
+	//writer未退出时不等待
+	start := time.Now()
+	channel.close(CloseKicked, []byte("bye"))
+	if d := time.Since(start); d > closeNotifyTimeout/2 {
+		t.Fatalf("close blocked for %v", d)
+	}
+
+	//writer退出后仍会发送 CmdClose
+	close(channel.writerDoneC)
+	msg := channel.MsgFactory().NewMessage()
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := msg.ReadFrom(peer); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Cmd() != consts.CmdClose || string(msg.Body()) != "bye" {
+		t.Errorf("wrong close message: %v %s", msg.Cmd(), msg.Body())
+	}
+}
+
+//认证时关闭连接，go test -race 检查
+func TestClose_DuringInit(t *testing.T) {
+	srv := NewServer(WithMsgProtocol(protocol.BINARY), WithSendCloseReason(true))
+	conn, peer := net.Pipe()
+	defer peer.Close()
+
+	channel := newChannel(conn, "tcp", srv, &srv.opts)
+	doneC := make(chan struct{})
+	go func() {
+		channel.Init("18", "web")
+		close(doneC)
+	}()
+	channel.CloseWithReason(CloseShutdown)
+	<-doneC
+}
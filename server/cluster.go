@@ -0,0 +1,283 @@
+package server
+
+import (
+	"context"
+	"github.com/kuhufu/cm/cluster"
+	logger "github.com/kuhufu/cm/logger"
+	"sync"
+	"time"
+)
+
+//其他节点转发来的推送进入发送队列的最长等待时间，避免队列满的连接阻塞处理后续消息
+const clusterPushTimeout = time.Second * 5
+
+//集群模式下本节点的房间路由
+//每个节点公布自己有连接的房间，推送时目标房间在其他节点上则转发给这些节点
+type clusterNode struct {
+	srv    *Server
+	broker cluster.Broker
+
+	localMu sync.Mutex          //保证本节点房间变化按顺序公布
+	local   map[string]struct{} //已公布的本节点房间
+	outbox  []outgoing          //待发送的房间变化，localMu 保护，由 sendLoop 按顺序发送
+	notifyC chan struct{}
+	exitC   chan struct{}
+	once    sync.Once
+
+	mu     sync.RWMutex
+	routes map[string]map[string]struct{} //room_id -> 有该房间的其他节点
+	nodes  map[string]map[string]struct{} //node_id -> 该节点的房间
+}
+
+func newClusterNode(srv *Server, broker cluster.Broker) *clusterNode {
+	return &clusterNode{
+		srv:     srv,
+		broker:  broker,
+		local:   map[string]struct{}{},
+		notifyC: make(chan struct{}, 1),
+		exitC:   make(chan struct{}),
+		routes:  map[string]map[string]struct{}{},
+		nodes:   map[string]map[string]struct{}{},
+	}
+}
+
+func (n *clusterNode) start() error {
+	if err := n.broker.Start(n.handle); err != nil {
+		return err
+	}
+
+	go n.sendLoop()
+
+	//请求其他节点发送各自的房间，还未启动的节点启动后会主动同步
+	n.localMu.Lock()
+	defer n.localMu.Unlock()
+	if err := n.broker.Publish(&cluster.Message{Type: cluster.MsgSync, RoomIds: n.localRooms(), Reply: true}); err != nil {
+		logger.Debugf("cluster sync error: %v", err)
+	}
+	return nil
+}
+
+func (n *clusterNode) close() error {
+	n.once.Do(func() {
+		close(n.exitC)
+	})
+	return n.broker.Close()
+}
+
+//房间变化，nodeId 为空时发给所有节点
+type outgoing struct {
+	nodeId string
+	msg    *cluster.Message
+}
+
+//调用方持有 localMu，不等待发送，避免连接其他节点时阻塞认证
+func (n *clusterNode) enqueue(nodeId string, msg *cluster.Message) {
+	n.outbox = append(n.outbox, outgoing{nodeId: nodeId, msg: msg})
+
+	select {
+	case n.notifyC <- struct{}{}:
+	default:
+	}
+}
+
+//按入队顺序发送房间变化和同步消息
+func (n *clusterNode) sendLoop() {
+	for {
+		select {
+		case <-n.exitC:
+			return
+		case <-n.notifyC:
+		}
+
+		n.localMu.Lock()
+		outbox := n.outbox
+		n.outbox = nil
+		n.localMu.Unlock()
+
+		for _, out := range outbox {
+			if out.nodeId == "" {
+				n.publish(out.msg)
+				continue
+			}
+			if err := n.broker.Send(out.nodeId, out.msg); err != nil && err != cluster.ErrClosed {
+				logger.Errorf("cluster %v to node %v error: %v", out.msg.Type, out.nodeId, err)
+			}
+		}
+	}
+}
+
+//本节点有了该房间的连接
+func (n *clusterNode) roomOnline(roomId string) {
+	n.localMu.Lock()
+	defer n.localMu.Unlock()
+
+	if _, ok := n.local[roomId]; ok {
+		return
+	}
+	n.local[roomId] = struct{}{}
+
+	n.enqueue("", &cluster.Message{Type: cluster.MsgRoomOnline, RoomIds: []string{roomId}})
+}
+
+//本节点该房间的连接都已断开
+func (n *clusterNode) roomOffline(roomId string) {
+	n.localMu.Lock()
+	defer n.localMu.Unlock()
+
+	if _, ok := n.srv.cm.Get(roomId); ok { //房间已重新创建
+		return
+	}
+	if _, ok := n.local[roomId]; !ok {
+		return
+	}
+	delete(n.local, roomId)
+
+	n.enqueue("", &cluster.Message{Type: cluster.MsgRoomOffline, RoomIds: []string{roomId}})
+}
+
+func (n *clusterNode) publish(msg *cluster.Message) {
+	if err := n.broker.Publish(msg); err != nil && err != cluster.ErrClosed {
+		logger.Errorf("cluster publish %v error: %v", msg.Type, err)
+	}
+}
+
+//调用方持有 localMu
+func (n *clusterNode) localRooms() []string {
+	rooms := make([]string, 0, len(n.local))
+	for roomId := range n.local {
+		rooms = append(rooms, roomId)
+	}
+	return rooms
+}
+
+//该房间是否在其他节点上
+func (n *clusterNode) hasRoute(roomId string) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	return len(n.routes[roomId]) > 0
+}
+
+//按节点转发，返回转发成功的节点数
+func (n *clusterNode) forward(roomIds []string, data []byte) int {
+	byNode := map[string][]string{}
+
+	n.mu.RLock()
+	for _, roomId := range roomIds {
+		for nodeId := range n.routes[roomId] {
+			byNode[nodeId] = append(byNode[nodeId], roomId)
+		}
+	}
+	n.mu.RUnlock()
+
+	count := 0
+	for nodeId, ids := range byNode {
+		err := n.broker.Send(nodeId, &cluster.Message{Type: cluster.MsgPush, RoomIds: ids, Data: data})
+		if err != nil {
+			logger.Errorf("cluster forward to node %v error: %v", nodeId, err)
+			continue
+		}
+		count++
+	}
+	return count
+}
+
+func (n *clusterNode) broadcast(data []byte) {
+	n.publish(&cluster.Message{Type: cluster.MsgBroadcast, Data: data})
+}
+
+//由 Broker 串行调用
+func (n *clusterNode) handle(msg *cluster.Message) {
+	logger.Debugf("cluster message from node %v: %v", msg.From, msg.Type)
+
+	switch msg.Type {
+	case cluster.MsgRoomOnline:
+		n.addRoutes(msg.From, msg.RoomIds)
+	case cluster.MsgRoomOffline:
+		n.delRoutes(msg.From, msg.RoomIds)
+	case cluster.MsgSync:
+		n.removeNode(msg.From)
+		n.addRoutes(msg.From, msg.RoomIds)
+		if msg.Reply {
+			n.sync(msg.From, false)
+		}
+	case cluster.MsgNodeJoin: //对方可能是重启或重连，双方重新交换房间
+		n.sync(msg.From, true)
+	case cluster.MsgNodeLeave:
+		n.removeNode(msg.From)
+		if err := n.srv.opts.Presence.RemoveNode(msg.From); err != nil {
+			logger.Errorf("presence remove node %v error: %v", msg.From, err)
+		}
+	case cluster.MsgPush:
+		ctx, cancel := context.WithTimeout(context.Background(), clusterPushTimeout)
+		n.srv.multicast(ctx, msg.Data, msg.RoomIds, false)
+		cancel()
+	case cluster.MsgBroadcast:
+		ctx, cancel := context.WithTimeout(context.Background(), clusterPushTimeout)
+		n.srv.broadcast(ctx, msg.Data, false)
+		cancel()
+	case cluster.MsgPublish:
+		ctx, cancel := context.WithTimeout(context.Background(), clusterPushTimeout)
+		n.srv.publish(ctx, msg.Topic, msg.Data, false)
+		cancel()
+	}
+}
+
+//发送本节点的全部房间，和房间变化一起排队，对方收到的顺序和本节点变化的顺序一致
+func (n *clusterNode) sync(nodeId string, reply bool) {
+	n.localMu.Lock()
+	defer n.localMu.Unlock()
+
+	n.enqueue(nodeId, &cluster.Message{Type: cluster.MsgSync, RoomIds: n.localRooms(), Reply: reply})
+}
+
+func (n *clusterNode) addRoutes(nodeId string, roomIds []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	rooms, ok := n.nodes[nodeId]
+	if !ok {
+		rooms = map[string]struct{}{}
+		n.nodes[nodeId] = rooms
+	}
+
+	for _, roomId := range roomIds {
+		rooms[roomId] = struct{}{}
+
+		nodes, ok := n.routes[roomId]
+		if !ok {
+			nodes = map[string]struct{}{}
+			n.routes[roomId] = nodes
+		}
+		nodes[nodeId] = struct{}{}
+	}
+}
+
+func (n *clusterNode) delRoutes(nodeId string, roomIds []string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for _, roomId := range roomIds {
+		delete(n.nodes[nodeId], roomId)
+		n.delRoute(roomId, nodeId)
+	}
+}
+
+func (n *clusterNode) removeNode(nodeId string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for roomId := range n.nodes[nodeId] {
+		n.delRoute(roomId, nodeId)
+	}
+	delete(n.nodes, nodeId)
+}
+
+//调用方持有 mu
+func (n *clusterNode) delRoute(roomId, nodeId string) {
+	nodes := n.routes[roomId]
+	delete(nodes, nodeId)
+	if len(nodes) == 0 {
+		delete(n.routes, roomId)
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"github.com/kuhufu/cm/cluster"
+	"github.com/kuhufu/cm/protocol"
+	"testing"
+	"time"
+)
+
+func TestCluster(t *testing.T) {
+	cases := []struct {
+		name string
+		//分配好所有节点的地址，返回创建节点 Broker 的函数，重启的节点用同一个id创建
+		setup func(ids []string) func(id string) cluster.Broker
+	}{
+		{"local", func(ids []string) func(id string) cluster.Broker {
+			hub := cluster.NewLocalHub()
+			return func(id string) cluster.Broker {
+				return hub.NewBroker(id)
+			}
+		}},
+		{"tcp", func(ids []string) func(id string) cluster.Broker {
+			peers := map[string]string{}
+			for _, id := range ids {
+				peers[id] = freeAddr(t)
+			}
+			return func(id string) cluster.Broker {
+				return cluster.NewTCPBroker(id, peers[id], peers)
+			}
+		}},
+	}
+
+	for _, cs := range cases {
+		t.Run(cs.name, func(t *testing.T) {
+			//先分配好所有地址，避免释放的端口被节点间连接占用
+			hosts := []string{freeAddr(t), freeAddr(t), freeAddr(t)}
+			ids := []string{"node1", "node2", "node3"}
+			newBroker := cs.setup(ids)
+
+			start := func(i int) *Server {
+				srv := NewServer(
+					WithHandler(echoHandler{}),
+					WithMsgProtocol(protocol.BINARY),
+					WithCluster(newBroker(ids[i])),
+				)
+				go srv.Run("tcp://" + hosts[i])
+				waitListen(hosts[i])
+				return srv
+			}
+
+			var servers []*Server
+			var addrs []string
+			for i := range ids {
+				srv := start(i)
+				defer srv.Close()
+
+				servers = append(servers, srv)
+				addrs = append(addrs, "tcp://"+hosts[i])
+			}
+
+			c1 := dial(t, addrs[0], "c1")
+			defer c1.Close()
+
+			c2 := dial(t, addrs[1], "c2")
+			defer c2.Close()
+
+			//等待房间公布到其他节点
+			waitForward := func(srv *Server, roomId string, data []byte) {
+				deadline := time.Now().Add(time.Second * 3)
+				for {
+					report := srv.UnicastContext(context.Background(), data, roomId)
+					if report.Online() {
+						return
+					}
+					if time.Now().After(deadline) {
+						t.Fatalf("room %v not routed", roomId)
+					}
+					time.Sleep(time.Millisecond * 10)
+				}
+			}
+
+			waitForward(servers[2], "c1", []byte("3->c1"))
+			expectPush(t, c1.Push(), "3->c1")
+
+			waitForward(servers[0], "c2", []byte("1->c2"))
+			expectPush(t, c2.Push(), "1->c2")
+
+			servers[2].Broadcast([]byte("all"))
+			expectPush(t, c1.Push(), "all")
+			expectPush(t, c2.Push(), "all")
+
+			if err := c2.Subscribe(context.Background(), "score"); err != nil {
+				t.Fatal(err)
+			}
+			servers[2].Publish("score", []byte("1:0"))
+			expectPush(t, c2.Push(), "1:0")
+
+			//节点下线后不再转发
+			servers[1].Close()
+			deadline := time.Now().Add(time.Second * 3)
+			for servers[0].UnicastContext(context.Background(), []byte("gone"), "c2").Forwarded != 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("route of closed node not removed")
+				}
+				time.Sleep(time.Millisecond * 10)
+			}
+
+			//节点重启后双方重新交换房间，其他节点到它的旧连接不能吞掉消息
+			servers[1] = start(1)
+			defer servers[1].Close()
+
+			c3 := dial(t, addrs[1], "c2")
+			defer c3.Close()
+
+			waitForward(servers[1], "c1", []byte("2->c1"))
+			expectPush(t, c1.Push(), "2->c1")
+
+			waitForward(servers[0], "c2", []byte("1->c2 again"))
+			expectPush(t, c3.Push(), "1->c2 again")
+		})
+	}
+}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"github.com/kuhufu/cm/protocol/Interface"
+	"github.com/kuhufu/cm/protocol/consts"
+)
+
+//自定义命令的处理函数，不要修改body，方法返回后不能再使用body
+//resp 不为nil时以相同的 cmd 和 RequestId 回复，err 不为nil时回复错误，见 Error
+type CmdHandler func(channel *Channel, body []byte) (resp []byte, err error)
+
+//注册自定义命令，cmd 不能小于 consts.CmdCustomStart，name 用于 Cmd.String
+//已认证的连接收到该命令时调用handler，应在 Run 之前注册
+func (srv *Server) HandleCmd(cmd Interface.Cmd, name string, handler CmdHandler) {
+	if cmd < consts.CmdCustomStart {
+		panic("custom cmd must not be less than consts.CmdCustomStart")
+	}
+	if handler == nil {
+		panic("cmd handler cannot be nil")
+	}
+
+	Interface.RegisterCmd(cmd, name)
+	srv.cmdHandlers.Store(cmd, handler)
+}
+
+func (srv *Server) cmdHandler(cmd Interface.Cmd) (CmdHandler, bool) {
+	handler, ok := srv.cmdHandlers.Load(cmd)
+	if !ok {
+		return nil, false
+	}
+	return handler.(CmdHandler), true
+}
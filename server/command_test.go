@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/kuhufu/cm/protocol/Interface"
+	"github.com/kuhufu/cm/protocol/consts"
+	"testing"
+	"time"
+)
+
+func TestCustomCmd(t *testing.T) {
+	srv, addr := runServer(t, "tcp")
+	defer srv.Close()
+
+	const (
+		cmdTyping = Interface.Cmd(consts.CmdCustomStart + iota)
+		cmdRead
+	)
+
+	srv.HandleCmd(cmdTyping, "CmdTyping", func(channel *Channel, body []byte) ([]byte, error) {
+		if len(body) == 0 {
+			return nil, NewError(consts.CodeBadRequest, "empty body")
+		}
+		return append([]byte(channel.RoomId()+" typing "), body...), nil
+	})
+
+	readC := make(chan string, 1)
+	srv.HandleCmd(cmdRead, "CmdRead", func(channel *Channel, body []byte) ([]byte, error) {
+		readC <- string(body)
+		return nil, nil
+	})
+
+	if name := cmdTyping.String(); name != "CmdTyping" {
+		t.Errorf("wrong name: %v", name)
+	}
+
+	c := dial(t, addr, "11")
+	defer c.Close()
+
+	reply, err := c.RequestCmd(context.Background(), cmdTyping, []byte("to 12"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reply) != "11 typing to 12" {
+		t.Errorf("wrong reply: %s", reply)
+	}
+
+	var e *Error
+	if _, err := c.RequestCmd(context.Background(), cmdTyping, nil); !errors.As(err, &e) || e.Code != consts.CodeBadRequest {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	if err := c.SendCmd(cmdRead, []byte("msg 1")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case body := <-readC:
+		if body != "msg 1" {
+			t.Errorf("wrong body: %v", body)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("read receipt timeout")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("builtin cmd should panic")
+		}
+	}()
+	srv.HandleCmd(consts.CmdPush, "CmdPush", func(channel *Channel, body []byte) ([]byte, error) {
+		return nil, nil
+	})
+}
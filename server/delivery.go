@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	logger "github.com/kuhufu/cm/logger"
+)
+
+//推送结果，单位是连接
+type DeliveryReport struct {
+	Targeted int `json:"targeted"` //目标连接数，包括被过滤的
+	Enqueued int `json:"enqueued"` //进入发送队列
+	Filtered int `json:"filtered"` //被过滤
+	TimedOut int `json:"timedOut"` //ctx结束前未能进入发送队列
+	Closed   int `json:"closed"`   //连接已关闭
+	Dropped  int `json:"dropped"`  //发送队列满被丢弃
+	Stored   int `json:"stored"`   //目标房间不存在，保存为离线消息的房间数
+
+	Forwarded int `json:"forwarded"` //集群模式下转发到的其他节点数，其他节点上的连接不计入以上各项
+}
+
+//至少有一个连接收到了推送，或已转发给有目标房间的其他节点
+func (r *DeliveryReport) Online() bool {
+	return r.Enqueued > 0 || r.Forwarded > 0
+}
+
+func (r *DeliveryReport) add(err error) {
+	switch err {
+	case nil:
+		r.Enqueued++
+	case ErrChannelClosed:
+		r.Closed++
+	case ErrQueueFull:
+		r.Dropped++
+	default:
+		r.TimedOut++
+	}
+}
+
+//ctx 控制每个连接进入发送队列的等待时间，ctx结束后剩余的连接计入 TimedOut
+//集群模式下目标房间在其他节点上时同时转发，filters 只作用于本节点的连接
+func (srv *Server) UnicastContext(ctx context.Context, data []byte, roomId string, filters ...ChannelFilter) DeliveryReport {
+	return srv.multicast(ctx, data, []string{roomId}, true, filters...)
+}
+
+func (srv *Server) MulticastContext(ctx context.Context, data []byte, roomIds []string, filters ...ChannelFilter) DeliveryReport {
+	return srv.multicast(ctx, data, roomIds, true, filters...)
+}
+
+func (srv *Server) BroadcastContext(ctx context.Context, data []byte, filters ...ChannelFilter) DeliveryReport {
+	return srv.broadcast(ctx, data, true, filters...)
+}
+
+//forward 为false时只推送本节点的连接，用于处理其他节点转发的消息
+func (srv *Server) multicast(ctx context.Context, data []byte, roomIds []string, forward bool, filters ...ChannelFilter) DeliveryReport {
+	var report DeliveryReport
+	encoder := newPushEncoder(data)
+	defer srv.metrics.observePush(time.Now(), &report)
+
+	clustered := forward && srv.cluster != nil
+	if clustered {
+		report.Forwarded = srv.cluster.forward(roomIds, data)
+	}
+
+	for _, id := range roomIds {
+		//房间在其他节点上时由其他节点推送，不保存离线消息
+		remote := clustered && srv.cluster.hasRoute(id)
+		if room, ok := srv.getRoomOrStore(id, data, &report, remote); ok {
+			srv.roomBroadcast(ctx, room, encoder, &report, filters...)
+		} else if !remote {
+			logger.Debugf("room:%v not exist", id)
+		}
+	}
+	return report
+}
+
+func (srv *Server) broadcast(ctx context.Context, data []byte, forward bool, filters ...ChannelFilter) DeliveryReport {
+	var report DeliveryReport
+	encoder := newPushEncoder(data)
+	defer srv.metrics.observePush(time.Now(), &report)
+
+	if forward && srv.cluster != nil {
+		srv.cluster.broadcast(data)
+	}
+
+	srv.allChannels.Range(func(key, value interface{}) bool {
+		srv.deliver(ctx, key.(*Channel), encoder, &report, filters...)
+		return true
+	})
+	return report
+}
+
+func (srv *Server) roomBroadcast(ctx context.Context, room *Room, encoder *pushEncoder, report *DeliveryReport, filters ...ChannelFilter) {
+	room.Range(func(id string, channel *Channel) bool {
+		srv.deliver(ctx, channel, encoder, report, filters...)
+		return true
+	})
+}
+
+func (srv *Server) deliver(ctx context.Context, channel *Channel, encoder *pushEncoder, report *DeliveryReport, filters ...ChannelFilter) {
+	report.Targeted++
+	for _, filter := range filters {
+		if !filter(channel) {
+			report.Filtered++
+			return
+		}
+	}
+	report.add(srv.push(ctx, channel, encoder))
+}
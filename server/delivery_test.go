@@ -0,0 +1,49 @@
+package server
+
+import (
+	"context"
+	"github.com/kuhufu/cm/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_UnicastContext(t *testing.T) {
+	srv := NewServer(WithMsgProtocol(protocol.BINARY))
+
+	conn, _ := net.Pipe()
+	channel := NewChannel(conn, "pipe", srv)
+	channel.Init("1", "web")
+	srv.cm.GetOrCreate("1").Add("web", channel)
+
+	ios := NewChannel(conn, "pipe", srv)
+	ios.Init("1", "ios")
+	srv.cm.GetOrCreate("1").Add("ios", ios)
+
+	webOnly := func(c *Channel) bool {
+		return c.Id() == "web"
+	}
+
+	//没有writer，队列满后超时
+	for i := 0; i < cap(channel.outBytesQueue); i++ {
+		report := srv.UnicastContext(context.Background(), []byte("hello"), "1", webOnly)
+		if report.Targeted != 2 || report.Filtered != 1 || report.Enqueued != 1 || !report.Online() {
+			t.Fatalf("wrong report: %+v", report)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if report := srv.UnicastContext(ctx, []byte("hello"), "1", webOnly); report.TimedOut != 1 {
+		t.Errorf("wrong report: %+v", report)
+	}
+
+	channel.Close()
+	if report := srv.UnicastContext(context.Background(), []byte("hello"), "1", webOnly); report.Closed != 1 {
+		t.Errorf("wrong report: %+v", report)
+	}
+
+	if report := srv.UnicastContext(context.Background(), []byte("hello"), "2"); report.Targeted != 0 || report.Online() {
+		t.Errorf("wrong report: %+v", report)
+	}
+}
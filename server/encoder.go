@@ -0,0 +1,38 @@
+package server
+
+import (
+	"github.com/kuhufu/cm/protocol"
+)
+
+//不同监听的连接可能使用不同的消息协议，一次推送中每种协议只encode一次
+//不是线程安全的，只在一次推送内使用
+type pushEncoder struct {
+	data    []byte
+	encoded map[interface{}][]byte
+}
+
+func newPushEncoder(data []byte) *pushEncoder {
+	return &pushEncoder{
+		data:    data,
+		encoded: map[interface{}][]byte{},
+	}
+}
+
+func (e *pushEncoder) Bytes(factory *protocol.MsgProtoFactory) []byte {
+	key := factoryKey(factory)
+	if data, ok := e.encoded[key]; ok {
+		return data
+	}
+
+	data := buildSrvPushMsgBytes(factory, e.data)
+	e.encoded[key] = data
+	return data
+}
+
+//内置协议按协议类型区分，自定义协议按factory区分
+func factoryKey(factory *protocol.MsgProtoFactory) interface{} {
+	if factory.Proto != protocol.NONE {
+		return factory.Proto
+	}
+	return factory
+}
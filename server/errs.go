@@ -1,9 +1,69 @@
 package server
 
-import "errors"
+import (
+	"errors"
+	"github.com/kuhufu/cm/protocol"
+	"github.com/kuhufu/cm/protocol/Interface"
+	"github.com/kuhufu/cm/protocol/consts"
+)
 
 var (
 	ErrRoomNotExist     = errors.New("room not exist")
+	ErrChannelNotExist  = errors.New("channel not exist")
+	ErrServerClosed     = errors.New("server closed")
+	ErrChannelClosed    = errors.New("channel closed")
+	ErrTooManyRequests  = errors.New("too many requests") //连接同时处理的请求数超过上限
+	ErrServerBusy       = errors.New("server busy")       //异步请求队列满
+	ErrUnknownCmd       = errors.New("unknown cmd")
+	ErrInvalidTopic     = errors.New("invalid topic")
+	ErrBanned           = errors.New("banned")            //被封禁，在封禁期内认证失败
+	ErrLoginRejected    = errors.New("login rejected")    //LoginPolicy 拒绝新连接
+	ErrQueueFull        = errors.New("out queue full")    //发送队列满，消息被丢弃
 	ErrAuthTimeout      = errors.New("auth timeout")      //认证超时
 	ErrHeartbeatTimeout = errors.New("heartbeat timeout") //心跳超时
 )
+
+//带状态码的错误，Handler、CmdHandler 和拦截器返回该类型时以其 Code 和 Message 回复
+type Error = protocol.Error
+
+func NewError(code uint32, message string) *Error {
+	return protocol.NewError(code, message)
+}
+
+//错误对应的状态码和回复的错误信息，其他错误的状态码为 consts.CodeUnknown
+func errorCode(err error) (uint32, string) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code, e.Message
+	}
+
+	switch {
+	case errors.Is(err, ErrTooManyRequests):
+		return consts.CodeTooManyRequests, err.Error()
+	case errors.Is(err, ErrServerBusy), errors.Is(err, ErrServerClosed):
+		return consts.CodeServerBusy, err.Error()
+	case errors.Is(err, ErrInvalidTopic):
+		return consts.CodeBadRequest, err.Error()
+	case errors.Is(err, ErrBanned), errors.Is(err, ErrLoginRejected):
+		return consts.CodeForbidden, err.Error()
+	}
+	return consts.CodeUnknown, err.Error()
+}
+
+//错误回复，body为错误信息，客户端不支持状态码时不设置 code
+func buildErrorMessage(channel *Channel, srcMsg Interface.Message, err error) Interface.Message {
+	code, text := errorCode(err)
+	msg := buildReplyMessage(channel.MsgFactory(), srcMsg, []byte(text))
+	if channel.supportsCode {
+		msg.SetCode(code)
+	}
+	return msg
+}
+
+//binary协议的旧版本客户端使用v1头部，无法解析 code
+func supportsCode(msg Interface.Message) bool {
+	if m, ok := msg.(interface{ SupportsCode() bool }); ok {
+		return m.SupportsCode()
+	}
+	return true
+}
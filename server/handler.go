@@ -6,3 +6,15 @@ type Handler interface {
 	OnReceive(channel *Channel, data []byte) (resp []byte)
 	OnClose(channel *Channel)
 }
+
+//Handler 可以选择实现，客户端通过 CmdSubscribe 订阅主题前调用，服务端 Subscribe 不经过这里
+//返回错误时拒绝订阅，以错误的状态码和错误信息回复
+type SubscribeHandler interface {
+	OnSubscribe(channel *Channel, topic string) error
+}
+
+//Handler 可以选择实现，实现后 CmdPush 请求由 OnRequest 处理，不再调用 OnReceive
+//返回错误时以错误的状态码和错误信息回复，返回 *Error 可以指定状态码
+type RequestHandler interface {
+	OnRequest(channel *Channel, data []byte) (resp []byte, err error)
+}
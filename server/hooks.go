@@ -0,0 +1,60 @@
+package server
+
+//以下接口 Handler 可以选择实现，通过类型断言检测，未实现时不调用
+
+//新连接建立，认证之前调用，返回错误时关闭连接
+type ConnectHandler interface {
+	OnConnect(channel *Channel) error
+}
+
+//认证失败，data 为认证消息的body，不要修改，方法返回后不能再使用
+//err 为认证拦截器返回的错误或 AuthReply.Err，AuthReply.Ok 为false时为nil
+type AuthFailedHandler interface {
+	OnAuthFailed(channel *Channel, data []byte, err error)
+}
+
+//收到心跳
+type HeartbeatHandler interface {
+	OnHeartbeat(channel *Channel)
+}
+
+//相同 ChannelId 的新连接认证成功，old 被关闭之后调用
+type ReplaceHandler interface {
+	OnReplace(old *Channel, new *Channel)
+}
+
+//连接关闭，在 OnClose 之前调用，err 为导致关闭的错误，客户端主动关闭时为nil
+type DisconnectHandler interface {
+	OnDisconnect(channel *Channel, reason CloseReason, err error)
+}
+
+func (srv *Server) onConnect(channel *Channel) error {
+	if h, ok := channel.opts.Handler.(ConnectHandler); ok {
+		return h.OnConnect(channel)
+	}
+	return nil
+}
+
+func (srv *Server) onAuthFailed(channel *Channel, data []byte, err error) {
+	if h, ok := channel.opts.Handler.(AuthFailedHandler); ok {
+		h.OnAuthFailed(channel, data, err)
+	}
+}
+
+func (srv *Server) onHeartbeat(channel *Channel) {
+	if h, ok := channel.opts.Handler.(HeartbeatHandler); ok {
+		h.OnHeartbeat(channel)
+	}
+}
+
+func (srv *Server) onReplace(old *Channel, new *Channel) {
+	if h, ok := new.opts.Handler.(ReplaceHandler); ok {
+		h.OnReplace(old, new)
+	}
+}
+
+func (srv *Server) onDisconnect(channel *Channel, reason CloseReason, err error) {
+	if h, ok := channel.opts.Handler.(DisconnectHandler); ok {
+		h.OnDisconnect(channel, reason, err)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/kuhufu/cm/client"
+	"github.com/kuhufu/cm/protocol/consts"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+//记录生命周期事件，reject 不为0时拒绝新连接，auth data 为 bad 时认证失败，为 err 时返回 AuthReply.Err
+type hookHandler struct {
+	echoHandler
+	events chan string
+	reject *int32
+}
+
+func (h hookHandler) record(event string) {
+	select {
+	case h.events <- event:
+	default:
+	}
+}
+
+func (h hookHandler) OnAuth(data []byte) *AuthReply {
+	if string(data) == "bad" {
+		return &AuthReply{Data: []byte("bad auth data")}
+	}
+	if string(data) == "err" {
+		return &AuthReply{Err: NewError(consts.CodeForbidden, "auth error")}
+	}
+	return h.echoHandler.OnAuth(data)
+}
+
+func (h hookHandler) OnConnect(channel *Channel) error {
+	if atomic.LoadInt32(h.reject) != 0 {
+		return errors.New("rejected")
+	}
+	return nil
+}
+
+func (h hookHandler) OnAuthFailed(channel *Channel, data []byte, err error) {
+	h.record(fmt.Sprintf("auth failed %s %v", data, err))
+}
+
+func (h hookHandler) OnHeartbeat(channel *Channel) {
+	h.record("heartbeat " + channel.RoomId())
+}
+
+func (h hookHandler) OnReplace(old *Channel, new *Channel) {
+	h.record(fmt.Sprintf("replace %v %v", old.RoomId(), old.Alive()))
+}
+
+func (h hookHandler) OnDisconnect(channel *Channel, reason CloseReason, err error) {
+	if channel.RoomId() != "" {
+		h.record(fmt.Sprintf("disconnect %v %v", channel.RoomId(), reason))
+	}
+}
+
+func TestHooks(t *testing.T) {
+	handler := hookHandler{events: make(chan string, 64), reject: new(int32)}
+	srv, addr := runServer(t, "tcp", WithHandler(handler))
+	defer srv.Close()
+
+	expect := func(want string) {
+		timeout := time.After(time.Second)
+		for {
+			select {
+			case event := <-handler.events:
+				if event == want {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("%v timeout", want)
+			}
+		}
+	}
+
+	var e *Error
+	if _, err := client.Dial(addr, []byte("bad")); !errors.As(err, &e) || e.Code != consts.CodeUnauthorized {
+		t.Errorf("wrong error: %v", err)
+	}
+	expect("auth failed bad <nil>")
+
+	if _, err := client.Dial(addr, []byte("err")); !errors.As(err, &e) || e.Code != consts.CodeForbidden || e.Message != "auth error" {
+		t.Errorf("wrong error: %v", err)
+	}
+	expect("auth failed err code: 4, auth error")
+
+	c1 := dial(t, addr, "14",
+		client.WithHeartbeatInterval(time.Millisecond*20),
+		client.WithHeartbeatTimeout(time.Second),
+	)
+	defer c1.Close()
+	expect("heartbeat 14")
+
+	c2 := dial(t, addr, "14")
+	defer c2.Close()
+	expect("replace 14 false")
+	expect("disconnect 14 replaced")
+
+	atomic.StoreInt32(handler.reject, 1)
+	if _, err := client.Dial(addr, []byte("15"), client.WithDialTimeout(time.Second)); err == nil {
+		t.Error("connection should be rejected")
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"github.com/kuhufu/cm/protocol/Interface"
+	"github.com/kuhufu/cm/protocol/consts"
+)
+
+//认证调用链的下一步，最后一步调用 Handler.OnAuth
+type AuthInvoker func(channel *Channel, msg Interface.Message) (*AuthReply, error)
+
+//认证拦截器，按添加顺序由外到内调用，不调用next直接返回即可短路
+//返回错误时认证失败，以错误的状态码和错误信息回复，连接可以继续认证
+//返回的 AuthReply 为nil时与 AuthReply.Ok 为false一样，回复 CodeUnauthorized
+type AuthInterceptor func(channel *Channel, msg Interface.Message, next AuthInvoker) (*AuthReply, error)
+
+//请求调用链的下一步，最后一步调用 Handler.OnReceive 或自定义命令的 CmdHandler
+type ReceiveInvoker func(channel *Channel, msg Interface.Message) ([]byte, error)
+
+//请求拦截器，作用于 CmdPush 和自定义命令，按添加顺序由外到内调用，不调用next直接返回即可短路
+//返回错误时以错误的状态码和错误信息回复，见 Error
+type ReceiveInterceptor func(channel *Channel, msg Interface.Message, next ReceiveInvoker) ([]byte, error)
+
+func chainAuth(interceptors []AuthInterceptor, final AuthInvoker) AuthInvoker {
+	invoker := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(channel *Channel, msg Interface.Message) (*AuthReply, error) {
+			return interceptor(channel, msg, next)
+		}
+	}
+	return invoker
+}
+
+func chainReceive(interceptors []ReceiveInterceptor, final ReceiveInvoker) ReceiveInvoker {
+	invoker := final
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		interceptor, next := interceptors[i], invoker
+		invoker = func(channel *Channel, msg Interface.Message) ([]byte, error) {
+			return interceptor(channel, msg, next)
+		}
+	}
+	return invoker
+}
+
+//AuthReply.Err 不为nil时作为错误返回，与拦截器返回的错误一样处理
+func (srv *Server) onAuth(channel *Channel, msg Interface.Message) (*AuthReply, error) {
+	reply := channel.opts.Handler.OnAuth(msg.Body())
+	if reply != nil && reply.Err != nil {
+		return nil, reply.Err
+	}
+	return reply, nil
+}
+
+//CmdPush 总是回复，自定义命令返回nil时不回复
+func (srv *Server) onReceive(channel *Channel, msg Interface.Message) ([]byte, error) {
+	if msg.Cmd() == consts.CmdPush {
+		var data []byte
+		if h, ok := channel.opts.Handler.(RequestHandler); ok {
+			var err error
+			if data, err = h.OnRequest(channel, msg.Body()); err != nil {
+				return nil, err
+			}
+		} else {
+			data = channel.opts.Handler.OnReceive(channel, msg.Body())
+		}
+		if data == nil {
+			data = []byte{}
+		}
+		return data, nil
+	}
+
+	handler, ok := srv.cmdHandler(msg.Cmd())
+	if !ok {
+		return nil, ErrUnknownCmd
+	}
+	return handler(channel, msg.Body())
+}
+
+//在已添加的拦截器之后添加，只对之后创建的监听有效
+func (srv *Server) AddAuthInterceptor(interceptors ...AuthInterceptor) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	WithAuthInterceptor(interceptors...)(&srv.opts)
+}
+
+func (srv *Server) AddReceiveInterceptor(interceptors ...ReceiveInterceptor) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	WithReceiveInterceptor(interceptors...)(&srv.opts)
+}
@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/kuhufu/cm/client"
+	"github.com/kuhufu/cm/protocol"
+	"github.com/kuhufu/cm/protocol/Interface"
+	"github.com/kuhufu/cm/protocol/consts"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestInterceptor(t *testing.T) {
+	host := freeAddr(t)
+	addr := "tcp://" + host
+
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) {
+		mu.Lock()
+		calls = append(calls, name)
+		mu.Unlock()
+	}
+
+	logging := func(name string) ReceiveInterceptor {
+		return func(channel *Channel, msg Interface.Message, next ReceiveInvoker) ([]byte, error) {
+			record(name + " before " + msg.Cmd().String())
+			resp, err := next(channel, msg)
+			record(name + " after")
+			return resp, err
+		}
+	}
+
+	srv := NewServer(
+		WithHandler(echoHandler{}),
+		WithMsgProtocol(protocol.BINARY),
+		WithReceiveInterceptor(logging("a"), logging("b")),
+	)
+	defer srv.Close()
+
+	srv.AddAuthInterceptor(func(channel *Channel, msg Interface.Message, next AuthInvoker) (*AuthReply, error) {
+		if string(msg.Body()) == "banned" {
+			return nil, NewError(consts.CodeForbidden, "forbidden")
+		}
+		if string(msg.Body()) == "anonymous" { //短路不返回 AuthReply
+			return nil, nil
+		}
+		return next(channel, msg)
+	})
+	srv.AddReceiveInterceptor(func(channel *Channel, msg Interface.Message, next ReceiveInvoker) ([]byte, error) {
+		if string(msg.Body()) == "flood" {
+			return nil, errors.New("rate limited")
+		}
+		return next(channel, msg)
+	})
+
+	go srv.Run(addr)
+	waitListen(host)
+
+	var e *Error
+	if _, err := client.Dial(addr, []byte("banned")); !errors.As(err, &e) || e.Code != consts.CodeForbidden {
+		t.Errorf("wrong error: %v", err)
+	}
+	if _, err := client.Dial(addr, []byte("anonymous")); !errors.As(err, &e) || e.Code != consts.CodeUnauthorized {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	c := dial(t, addr, "12")
+	defer c.Close()
+
+	ctx := context.Background()
+	if reply, _ := c.Request(ctx, []byte("hello")); string(reply) != "hello" {
+		t.Errorf("wrong reply: %s", reply)
+	}
+	if _, err := c.Request(ctx, []byte("flood")); !errors.As(err, &e) || e.Code != consts.CodeUnknown || e.Message != "rate limited" {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"a before CmdPush", "b before CmdPush", "b after", "a after", "a before CmdPush", "b before CmdPush", "b after", "a after"}
+	if strings.Join(calls, ",") != strings.Join(want, ",") {
+		t.Errorf("wrong calls: %v", calls)
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	logger "github.com/kuhufu/cm/logger"
+	"sync"
+	"time"
+)
+
+//先发送body为reason的 CmdClose 再关闭连接，不等待发送完成，reason为空时body为 CloseKicked
+//只作用于本节点的连接
+func (srv *Server) Kick(roomId string, channelId string, reason []byte) error {
+	room, ok := srv.cm.Get(roomId)
+	if !ok {
+		return ErrRoomNotExist
+	}
+
+	channel, ok := room.Get(channelId)
+	if !ok {
+		return ErrChannelNotExist
+	}
+
+	channel.kick(reason)
+	return nil
+}
+
+//踢掉房间内所有连接，返回踢掉的连接数
+func (srv *Server) KickRoom(roomId string, reason []byte) int {
+	room, ok := srv.cm.Get(roomId)
+	if !ok {
+		return 0
+	}
+
+	n := 0
+	room.Range(func(id string, channel *Channel) bool {
+		channel.kick(reason)
+		n++
+		return true
+	})
+	return n
+}
+
+func (c *Channel) kick(reason []byte) {
+	if len(reason) == 0 {
+		reason = []byte(CloseKicked.String())
+	}
+	logger.Printf("%v, kicked: %s", c, reason)
+	c.close(CloseKicked, reason)
+}
+
+//d时间内拒绝 roomId 的认证，channelId 为空时封禁整个房间
+//封禁在 OnAuth 确定房间之后、连接加入房间之前检查，回复 ErrBanned，状态码为 consts.CodeForbidden
+func (srv *Server) Ban(roomId string, channelId string, d time.Duration) {
+	srv.bans.add(banKey{roomId, channelId}, time.Now().Add(d))
+}
+
+func (srv *Server) Unban(roomId string, channelId string) {
+	srv.bans.del(banKey{roomId, channelId})
+}
+
+//房间或连接是否在封禁期内
+func (srv *Server) Banned(roomId string, channelId string) bool {
+	now := time.Now()
+	return srv.bans.banned(banKey{roomId, ""}, now) || srv.bans.banned(banKey{roomId, channelId}, now)
+}
+
+type banKey struct {
+	roomId    string
+	channelId string
+}
+
+//封禁列表，过期的记录在检查和添加时删除
+type banList struct {
+	mu      sync.Mutex
+	entries map[banKey]time.Time //解封时间
+}
+
+func newBanList() *banList {
+	return &banList{
+		entries: map[banKey]time.Time{},
+	}
+}
+
+func (b *banList) add(key banKey, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	for k, t := range b.entries {
+		if !now.Before(t) {
+			delete(b.entries, k)
+		}
+	}
+	b.entries[key] = until
+}
+
+func (b *banList) del(key banKey) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.entries, key)
+}
+
+func (b *banList) banned(key banKey, now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.entries[key]
+	if !ok {
+		return false
+	}
+	if !now.Before(until) {
+		delete(b.entries, key)
+		return false
+	}
+	return true
+}
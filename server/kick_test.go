@@ -0,0 +1,56 @@
+package server
+
+import (
+	"errors"
+	"github.com/kuhufu/cm/client"
+	"github.com/kuhufu/cm/protocol/consts"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestKickBan(t *testing.T) {
+	srv, addr := runServer(t, "tcp")
+	defer srv.Close()
+
+	c := dial(t, addr, "18")
+	defer c.Close()
+
+	if err := srv.Kick("18", "web", []byte("bye")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.Exit():
+		if err := c.Err(); !errors.Is(err, client.ErrClosed) || !strings.Contains(err.Error(), "bye") {
+			t.Errorf("wrong error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("kicked client not closed")
+	}
+	if err := srv.Kick("18", "web", nil); err == nil {
+		t.Error("channel should not exist")
+	}
+
+	srv.Ban("18", "", time.Millisecond*100)
+	var e *Error
+	if _, err := client.Dial(addr, []byte("18:ios")); !errors.As(err, &e) || e.Code != consts.CodeForbidden {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	//封禁过期
+	time.Sleep(time.Millisecond * 100)
+	c2 := dial(t, addr, "18:ios")
+	defer c2.Close()
+
+	srv.Ban("18", "ios", time.Minute)
+	if n := srv.KickRoom("18", nil); n != 1 {
+		t.Errorf("wrong kicked: %v", n)
+	}
+	if _, err := client.Dial(addr, []byte("18:ios")); !errors.As(err, &e) || e.Code != consts.CodeForbidden {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	srv.Unban("18", "ios")
+	c3 := dial(t, addr, "18:ios")
+	c3.Close()
+}
@@ -2,9 +2,12 @@ package server
 
 import (
 	"github.com/kuhufu/cm/transport/tcp"
+	"github.com/kuhufu/cm/transport/unix"
 	"github.com/kuhufu/cm/transport/ws"
 	"net"
+	"net/http"
 	"net/url"
+	"strings"
 )
 
 func getListener(addr string, options Options) (net.Listener, error) {
@@ -26,14 +29,24 @@ func getListener(addr string, options Options) (net.Listener, error) {
 
 		return tcp.Listen(scheme, parse.Host, opts)
 	case "ws", "wss":
+		//每个监听使用自己的 ServeMux，不同端口可以使用相同的path，也不会收到其他监听的path
 		opts := ws.Options{
 			CertFile:     options.CertFile,
 			KeyFile:      options.KeyFile,
 			TlsConfig:    options.TlsConfig,
+			ServeMux:     http.NewServeMux(),
 			ReadTimeout:  options.ReadTimeout,
 			WriteTimeout: options.WriteTimeout,
 		}
 		return ws.Listen(scheme, parse.Host+parse.Path, opts)
+	case "unix":
+		//unix:///run/cm.sock 为绝对路径，unix://cm.sock 为相对路径
+		opts := unix.Options{
+			FileMode:     options.UnixSocketMode,
+			ReadTimeout:  options.ReadTimeout,
+			WriteTimeout: options.WriteTimeout,
+		}
+		return unix.Listen(strings.TrimPrefix(addr, "unix://"), opts)
 	default:
 		panic("不支持的协议类型")
 	}
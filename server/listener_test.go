@@ -0,0 +1,73 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/kuhufu/cm/client"
+	"github.com/kuhufu/cm/protocol"
+	"github.com/kuhufu/cm/transport/unix"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnixSocket(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cm.sock")
+	addr := "unix://" + path
+
+	//进程异常退出留下的socket文件
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.SetUnlinkOnClose(false)
+	ln.Close()
+
+	srv := NewServer(
+		WithHandler(echoHandler{}),
+		WithMsgProtocol(protocol.BINARY),
+		WithUnixSocketMode(0600),
+	)
+	defer srv.Close()
+	go srv.Run(addr)
+
+	var c *client.Client
+	for i := 0; i < 100; i++ {
+		if c, err = client.Dial(addr, []byte("21")); err == nil {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("wrong socket file: %v, %v", info, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	resp, err := c.Request(ctx, []byte("ping"))
+	cancel()
+	if err != nil || string(resp) != "ping" {
+		t.Errorf("wrong response: %s, %v", resp, err)
+	}
+
+	if err := NewServer(WithHandler(echoHandler{})).Run(addr); !errors.Is(err, unix.ErrAddrInUse) {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	srv.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file not removed: %v", err)
+	}
+}
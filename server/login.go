@@ -0,0 +1,112 @@
+package server
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+)
+
+//多端登录策略，新连接认证成功、加入房间之前调用，同一房间的登录串行执行
+//channel 为新连接，已设置 RoomId 和 Id，online 为房间内本节点已有的连接
+//返回需要踢掉的连接，返回错误时拒绝新连接，以错误的状态码回复，连接可以继续认证
+//相同 ChannelId 的旧连接总是被替换，除非返回错误
+type LoginPolicy func(channel *Channel, online []*Channel) (evict []*Channel, err error)
+
+//默认策略，每种设备(ChannelId)一个连接，新连接替换旧连接
+func LoginReplace(channel *Channel, online []*Channel) ([]*Channel, error) {
+	return nil, nil
+}
+
+//房间内只保留一个连接
+func LoginSingleDevice(channel *Channel, online []*Channel) ([]*Channel, error) {
+	return online, nil
+}
+
+//房间内最多n个连接，超过时踢掉最早的连接
+func LoginMaxDevices(n int) LoginPolicy {
+	return func(channel *Channel, online []*Channel) ([]*Channel, error) {
+		others := make([]*Channel, 0, len(online))
+		for _, c := range online {
+			if c.Id() != channel.Id() {
+				others = append(others, c)
+			}
+		}
+
+		over := len(others) + 1 - n
+		if over <= 0 {
+			return nil, nil
+		}
+
+		sort.Slice(others, func(i, j int) bool {
+			return others[i].CreateTime.Before(others[j].CreateTime)
+		})
+		if over > len(others) {
+			over = len(others)
+		}
+		return others[:over], nil
+	}
+}
+
+//policy 需要踢掉已有连接时改为拒绝新连接，回复 ErrLoginRejected
+func LoginRejectNew(policy LoginPolicy) LoginPolicy {
+	return func(channel *Channel, online []*Channel) ([]*Channel, error) {
+		evict, err := policy(channel, online)
+		if err != nil {
+			return nil, err
+		}
+		if len(evict) > 0 {
+			return nil, ErrLoginRejected
+		}
+		for _, c := range online {
+			if c.Id() == channel.Id() {
+				return nil, ErrLoginRejected
+			}
+		}
+		return nil, nil
+	}
+}
+
+//按房间分段的登录锁
+type loginLocks [32]sync.Mutex
+
+func (l *loginLocks) get(roomId string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(roomId))
+	return &l[h.Sum32()%uint32(len(l))]
+}
+
+//按策略得到需要踢掉的连接，相同 ChannelId 的旧连接不在其中
+func (srv *Server) evaluateLogin(channel *Channel) ([]*Channel, error) {
+	var online []*Channel
+	if room, ok := srv.cm.Get(channel.RoomId()); ok {
+		room.Range(func(id string, c *Channel) bool {
+			online = append(online, c)
+			return true
+		})
+	}
+	if len(online) == 0 {
+		return nil, nil
+	}
+
+	policy := channel.opts.LoginPolicy
+	if policy == nil {
+		policy = LoginReplace
+	}
+
+	evict, err := policy(channel, online)
+	if err != nil {
+		return nil, err
+	}
+
+	//去掉相同 ChannelId 的旧连接和重复的连接，旧连接由 AddOrReplace 替换
+	seen := map[*Channel]struct{}{channel: {}}
+	channels := make([]*Channel, 0, len(evict))
+	for _, c := range evict {
+		if _, ok := seen[c]; ok || c.Id() == channel.Id() {
+			continue
+		}
+		seen[c] = struct{}{}
+		channels = append(channels, c)
+	}
+	return channels, nil
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"errors"
+	"github.com/kuhufu/cm/client"
+	"github.com/kuhufu/cm/protocol"
+	"github.com/kuhufu/cm/protocol/consts"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginPolicy(t *testing.T) {
+	run := func(policy LoginPolicy) (*Server, string) {
+		return runServer(t, "tcp", WithLoginPolicy(policy))
+	}
+
+	expectClosed := func(c *client.Client) {
+		select {
+		case <-c.Exit():
+		case <-time.After(time.Second):
+			t.Fatal("evicted client not closed")
+		}
+	}
+
+	expectOpen := func(c *client.Client) {
+		select {
+		case <-c.Exit():
+			t.Fatalf("client closed: %v", c.Err())
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+
+	t.Run("single device", func(t *testing.T) {
+		srv, addr := run(LoginSingleDevice)
+		defer srv.Close()
+
+		web := dial(t, addr, "19:web")
+		defer web.Close()
+		ios := dial(t, addr, "19:ios")
+		defer ios.Close()
+
+		expectClosed(web)
+		expectOpen(ios)
+		if n := srv.CloseStats()[CloseEvicted]; n != 1 {
+			t.Errorf("wrong evicted count: %v", n)
+		}
+	})
+
+	t.Run("max devices", func(t *testing.T) {
+		srv, addr := run(LoginMaxDevices(2))
+		defer srv.Close()
+
+		web := dial(t, addr, "19:web")
+		defer web.Close()
+		ios := dial(t, addr, "19:ios")
+		defer ios.Close()
+		expectOpen(web)
+
+		android := dial(t, addr, "19:android")
+		defer android.Close()
+		expectClosed(web)
+		expectOpen(ios)
+
+		//相同 ChannelId 替换，不踢其他连接
+		ios2 := dial(t, addr, "19:ios")
+		defer ios2.Close()
+		expectClosed(ios)
+		expectOpen(android)
+
+		stats := srv.CloseStats()
+		if stats[CloseEvicted] != 1 || stats[CloseReplaced] != 1 {
+			t.Errorf("wrong close stats: evicted %v, replaced %v", stats[CloseEvicted], stats[CloseReplaced])
+		}
+	})
+
+	t.Run("reject new", func(t *testing.T) {
+		srv, addr := run(LoginRejectNew(LoginSingleDevice))
+		defer srv.Close()
+
+		web := dial(t, addr, "19:web")
+		defer web.Close()
+
+		var e *Error
+		for _, token := range []string{"19:ios", "19:web"} {
+			if _, err := client.Dial(addr, []byte(token)); !errors.As(err, &e) || e.Code != consts.CodeForbidden {
+				t.Errorf("%v: wrong error: %v", token, err)
+			}
+		}
+		expectOpen(web)
+
+		other := dial(t, addr, "20:ios")
+		other.Close()
+	})
+}
+
+//被拒绝后重试不会延长认证超时
+func TestLoginPolicy_AuthTimeout(t *testing.T) {
+	srv, addr := runServer(t, "tcp", WithLoginPolicy(LoginRejectNew(LoginSingleDevice)), WithAuthTimeout(time.Millisecond*300))
+	defer srv.Close()
+
+	web := dial(t, addr, "21:web")
+	defer web.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	factory := protocol.GetFactory(protocol.BINARY)
+	deadline := time.Now().Add(time.Second * 2)
+	for time.Now().Before(deadline) {
+		msg := factory.NewDefaultMessage().SetCmd(consts.CmdAuth).SetRequestId(1).SetBody([]byte("21:ios"))
+		if _, err := msg.WriteTo(conn); err != nil {
+			return
+		}
+		if _, err := msg.ReadFrom(conn); err != nil {
+			return
+		}
+		if string(msg.Body()) != ErrLoginRejected.Error() {
+			t.Fatalf("wrong reply: %s", msg.Body())
+		}
+		time.Sleep(time.Millisecond * 50)
+	}
+	t.Error("rejected connection not closed by auth timeout")
+}
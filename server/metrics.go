@@ -0,0 +1,153 @@
+package server
+
+import (
+	"github.com/kuhufu/cm/metrics"
+	"github.com/kuhufu/cm/protocol/Interface"
+	"github.com/kuhufu/cm/transport"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//推送扇出的连接数区间
+var fanoutBuckets = []float64{1, 2, 5, 10, 50, 100, 500, 1000, 5000, 10000, 50000}
+
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	accepted     *metrics.Counter
+	auth         *metrics.CounterVec //result: ok, failed, error, banned, rejected
+	msgIn        *metrics.CounterVec //cmd
+	msgOut       *metrics.CounterVec //cmd
+	bytesIn      *metrics.Counter
+	bytesOut     *metrics.Counter
+	pushDuration *metrics.Histogram //一次推送进入所有目标连接发送队列的耗时
+	pushFanout   *metrics.Histogram //一次推送的目标连接数
+}
+
+func newServerMetrics(srv *Server) *serverMetrics {
+	r := metrics.NewRegistry()
+	m := &serverMetrics{
+		registry:     r,
+		accepted:     r.NewCounter("cm_connections_accepted_total", "Accepted connections."),
+		auth:         r.NewCounterVec("cm_auth_total", "Auth attempts by result.", "result"),
+		msgIn:        r.NewCounterVec("cm_messages_in_total", "Messages received by cmd.", "cmd"),
+		msgOut:       r.NewCounterVec("cm_messages_out_total", "Messages sent by cmd.", "cmd"),
+		bytesIn:      r.NewCounter("cm_bytes_in_total", "Bytes received."),
+		bytesOut:     r.NewCounter("cm_bytes_out_total", "Bytes sent."),
+		pushDuration: r.NewHistogram("cm_push_duration_seconds", "Time to enqueue a push to all target channels.", metrics.DefaultBuckets),
+		pushFanout:   r.NewHistogram("cm_push_fanout", "Target channels of a push.", fanoutBuckets),
+	}
+
+	r.NewGaugeFunc("cm_connections", "Open connections, including unauthenticated.", func() float64 {
+		return float64(countSyncMap(&srv.channels))
+	})
+	r.NewGaugeFunc("cm_channels", "Authenticated connections.", func() float64 {
+		return float64(countSyncMap(&srv.allChannels))
+	})
+	r.NewGaugeFunc("cm_rooms", "Rooms with at least one connection.", func() float64 {
+		n := 0
+		srv.cm.Range(func(key string, val *Room) bool {
+			n++
+			return true
+		})
+		return float64(n)
+	})
+	r.NewGaugeFunc("cm_out_queue_length", "Messages waiting in all send queues.", func() float64 {
+		n := 0
+		srv.allChannels.Range(func(key, value interface{}) bool {
+			n += key.(*Channel).QueueLen()
+			return true
+		})
+		return float64(n)
+	})
+	r.NewCounterVecFunc("cm_closed_total", "Closed connections by reason.", "reason", func() map[string]float64 {
+		values := map[string]float64{}
+		for reason, n := range srv.CloseStats() {
+			values[reason.String()] = float64(n)
+		}
+		return values
+	})
+	r.NewCounterVecFunc("cm_overflow_total", "Send queue overflows by policy action.", "action", func() map[string]float64 {
+		stats := srv.OverflowStats()
+		return map[string]float64{
+			"blocked":        float64(stats.Blocked),
+			"block_timeout":  float64(stats.BlockTimeouts),
+			"dropped_newest": float64(stats.DroppedNewest),
+			"dropped_oldest": float64(stats.DroppedOldest),
+			"disconnected":   float64(stats.Disconnected),
+		}
+	})
+
+	return m
+}
+
+//Prometheus 文本格式的指标
+func (srv *Server) MetricsHandler() http.Handler {
+	return srv.metrics.registry
+}
+
+//指标注册表，可以注册业务自己的指标，和服务端指标一起输出
+func (srv *Server) MetricsRegistry() *metrics.Registry {
+	return srv.metrics.registry
+}
+
+func (m *serverMetrics) messageIn(cmd Interface.Cmd) {
+	m.msgIn.With(cmd.String()).Inc()
+}
+
+func (m *serverMetrics) messageOut(cmd Interface.Cmd) {
+	m.msgOut.With(cmd.String()).Inc()
+}
+
+func (m *serverMetrics) observePush(start time.Time, report *DeliveryReport) {
+	m.pushDuration.Observe(time.Since(start).Seconds())
+	m.pushFanout.Observe(float64(report.Targeted))
+}
+
+//统计读写的字节数，websocket连接需要保留 ReadBlock
+func (m *serverMetrics) wrapConn(conn net.Conn) net.Conn {
+	c := &countConn{Conn: conn, m: m}
+	if bc, ok := conn.(transport.BlockConn); ok {
+		return &countBlockConn{countConn: c, block: bc}
+	}
+	return c
+}
+
+type countConn struct {
+	net.Conn
+	m *serverMetrics
+}
+
+func (c *countConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.m.bytesIn.Add(uint64(n))
+	return n, err
+}
+
+func (c *countConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.m.bytesOut.Add(uint64(n))
+	return n, err
+}
+
+type countBlockConn struct {
+	*countConn
+	block transport.BlockConn
+}
+
+func (c *countBlockConn) ReadBlock() ([]byte, error) {
+	data, err := c.block.ReadBlock()
+	c.m.bytesIn.Add(uint64(len(data)))
+	return data, err
+}
+
+func countSyncMap(m *sync.Map) int {
+	n := 0
+	m.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	srv, addr := runServer(t, "tcp")
+	defer srv.Close()
+
+	c := dial(t, addr, "17")
+	defer c.Close()
+
+	if _, err := c.Request(context.Background(), []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	srv.Unicast([]byte("push"), "17")
+	expectPush(t, c.Push(), "push")
+
+	//直接通过 Room 推送同样编码和统计
+	room, _ := srv.GetRoom("17")
+	room.Broadcast([]byte("room push"))
+	expectPush(t, c.Push(), "room push")
+
+	w := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+
+	for _, want := range []string{
+		`cm_auth_total{result="ok"} 1`,
+		`cm_channels 1`,
+		`cm_rooms 1`,
+		`cm_messages_in_total{cmd="CmdPush"} 1`,
+		`cm_messages_out_total{cmd="CmdServerPush"} 2`,
+		`cm_push_fanout_count 2`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("missing %v", want)
+		}
+	}
+	if strings.Contains(body, "cm_bytes_in_total 0\n") {
+		t.Error("bytes in not counted")
+	}
+}
@@ -2,10 +2,10 @@ package server
 
 import (
 	"crypto/tls"
+	"github.com/kuhufu/cm/cluster"
 	logger "github.com/kuhufu/cm/logger"
 	"github.com/kuhufu/cm/protocol"
-	"github.com/kuhufu/cm/protocol/binary"
-	"github.com/kuhufu/cm/protocol/json"
+	"os"
 	"time"
 )
 
@@ -26,14 +26,56 @@ type Options struct {
 	ReadTimeout time.Duration
 	//写超时时间，0表示不超时
 	WriteTimeout time.Duration
+	//unix socket文件的权限，0表示由umask决定
+	UnixSocketMode os.FileMode
 
+	//消息协议，可以按监听地址设置
 	MsgFactory *protocol.MsgProtoFactory
+
+	//Shutdown时 CmdClose 消息的body
+	ShutdownReason []byte
+
+	//服务端主动关闭已认证的连接时，先发送body为 CloseReason 的 CmdClose
+	SendCloseReason bool
+
+	//多端登录策略，nil 时为 LoginReplace
+	LoginPolicy LoginPolicy
+
+	//可靠推送，nil表示不开启，仅 NewServer 时设置有效
+	Reliable *ReliableOptions
+
+	//离线消息存储，nil表示不保存
+	MessageStore MessageStore
+
+	//每个连接发送队列的长度，默认4
+	OutQueueSize int
+	//推送时发送队列满的处理方式，默认阻塞
+	OverflowPolicy OverflowPolicy
+	//OverflowBlock 的最长阻塞时间，0表示一直阻塞
+	OverflowBlockTimeout time.Duration
+
+	//集群节点间的消息传输，nil表示单机，仅 NewServer 时设置有效
+	Broker cluster.Broker
+
+	//异步处理请求，nil表示在读goroutine中同步处理，仅 NewServer 时设置有效
+	Async *AsyncOptions
+
+	//认证拦截器，按顺序由外到内调用
+	AuthInterceptors []AuthInterceptor
+	//请求拦截器，按顺序由外到内调用
+	ReceiveInterceptors []ReceiveInterceptor
+
+	//在线状态存储，默认进程内存储
+	Presence PresenceStore
+	//本节点连接的上线、下线事件，在连接的goroutine中调用，不能阻塞
+	OnPresence func(event PresenceEvent)
 }
 
 func defaultOptions() Options {
 	return Options{
 		AuthTimeout:      time.Second * 10,
 		HeartbeatTimeout: time.Second * 90,
+		Presence:         NewMemoryPresence(),
 	}
 }
 
@@ -51,6 +93,13 @@ func WithWriteTimeout(duration time.Duration) Option {
 	}
 }
 
+//监听地址为 unix:// 时有效
+func WithUnixSocketMode(mode os.FileMode) Option {
+	return func(o *Options) {
+		o.UnixSocketMode = mode
+	}
+}
+
 func WithAuthTimeout(duration time.Duration) Option {
 	return func(o *Options) {
 		o.AuthTimeout = duration
@@ -94,28 +143,94 @@ func WithTlsConfig(config *tls.Config) Option {
 	}
 }
 
-func WithMsgProtocol(proto protocol.MsgProto) Option {
+func WithShutdownReason(reason []byte) Option {
+	return func(o *Options) {
+		o.ShutdownReason = reason
+	}
+}
 
-	var factory *protocol.MsgProtoFactory
-	switch proto {
-	case protocol.BINARY:
-		factory = &protocol.MsgProtoFactory{
-			NewMessage:        binary.NewMessage,
-			NewDefaultMessage: binary.NewDefaultMessage,
-			GetPoolMsg:        binary.GetPoolMsg,
-			FreePoolMsg:       binary.FreePoolMsg,
-		}
-	case protocol.JSON:
-		factory = &protocol.MsgProtoFactory{
-			NewMessage:        json.NewMessage,
-			NewDefaultMessage: json.NewDefaultMessage,
-			GetPoolMsg:        json.GetPoolMsg,
-			FreePoolMsg:       json.FreePoolMsg,
+func WithSendCloseReason(send bool) Option {
+	return func(o *Options) {
+		o.SendCloseReason = send
+	}
+}
+
+func WithLoginPolicy(policy LoginPolicy) Option {
+	return func(o *Options) {
+		o.LoginPolicy = policy
+	}
+}
+
+func WithReliablePush(opts ReliableOptions) Option {
+	return func(o *Options) {
+		o.Reliable = &opts
+	}
+}
+
+func WithAsyncReceive(opts AsyncOptions) Option {
+	return func(o *Options) {
+		o.Async = &opts
+	}
+}
+
+func WithMessageStore(store MessageStore) Option {
+	return func(o *Options) {
+		o.MessageStore = store
+	}
+}
+
+//集群模式，Unicast/Multicast/Broadcast 会转发到有目标房间的其他节点
+//多个节点使用离线消息时 MessageStore 需要是共享的存储
+func WithCluster(broker cluster.Broker) Option {
+	return func(o *Options) {
+		o.Broker = broker
+	}
+}
+
+//追加到已有的拦截器之后
+func WithAuthInterceptor(interceptors ...AuthInterceptor) Option {
+	return func(o *Options) {
+		//复制，避免和其他监听的配置共用底层数组
+		o.AuthInterceptors = append(append([]AuthInterceptor{}, o.AuthInterceptors...), interceptors...)
+	}
+}
+
+func WithReceiveInterceptor(interceptors ...ReceiveInterceptor) Option {
+	return func(o *Options) {
+		o.ReceiveInterceptors = append(append([]ReceiveInterceptor{}, o.ReceiveInterceptors...), interceptors...)
+	}
+}
+
+//store 为nil时使用默认存储，onEvent 可以为nil
+func WithPresence(store PresenceStore, onEvent func(event PresenceEvent)) Option {
+	return func(o *Options) {
+		if store != nil {
+			o.Presence = store
 		}
-	case protocol.PROTOBUF:
-		panic("unsupported")
+		o.OnPresence = onEvent
+	}
+}
+
+func WithOutQueueSize(size int) Option {
+	return func(o *Options) {
+		o.OutQueueSize = size
 	}
+}
+
+//timeout 仅对 OverflowBlock 有效
+func WithOverflowPolicy(policy OverflowPolicy, timeout time.Duration) Option {
+	return func(o *Options) {
+		o.OverflowPolicy = policy
+		o.OverflowBlockTimeout = timeout
+	}
+}
+
+func WithMsgProtocol(proto protocol.MsgProto) Option {
+	return WithMsgFactory(protocol.GetFactory(proto))
+}
 
+//自定义消息协议
+func WithMsgFactory(factory *protocol.MsgProtoFactory) Option {
 	return func(o *Options) {
 		o.MsgFactory = factory
 	}
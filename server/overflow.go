@@ -0,0 +1,46 @@
+package server
+
+import "sync/atomic"
+
+const DefaultOutQueueSize = 4
+
+//推送时连接发送队列满的处理方式
+type OverflowPolicy int
+
+const (
+	OverflowBlock      OverflowPolicy = iota //阻塞等待，超过 OverflowBlockTimeout 丢弃
+	OverflowDropNewest                       //丢弃新消息
+	OverflowDropOldest                       //丢弃队列中最旧的消息
+	OverflowDisconnect                       //断开慢连接
+)
+
+var overflowPolicyMap = map[OverflowPolicy]string{
+	OverflowBlock:      "block",
+	OverflowDropNewest: "drop_newest",
+	OverflowDropOldest: "drop_oldest",
+	OverflowDisconnect: "disconnect",
+}
+
+func (p OverflowPolicy) String() string {
+	return overflowPolicyMap[p]
+}
+
+//各处理方式触发的次数
+type OverflowStats struct {
+	Blocked       uint64 //阻塞等待
+	BlockTimeouts uint64 //阻塞超时
+	DroppedNewest uint64
+	DroppedOldest uint64
+	Disconnected  uint64
+}
+
+func (srv *Server) OverflowStats() OverflowStats {
+	stats := &srv.overflowStats
+	return OverflowStats{
+		Blocked:       atomic.LoadUint64(&stats.Blocked),
+		BlockTimeouts: atomic.LoadUint64(&stats.BlockTimeouts),
+		DroppedNewest: atomic.LoadUint64(&stats.DroppedNewest),
+		DroppedOldest: atomic.LoadUint64(&stats.DroppedOldest),
+		Disconnected:  atomic.LoadUint64(&stats.Disconnected),
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"context"
+	"github.com/kuhufu/cm/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestChannel_EnterOutBytesOverflow(t *testing.T) {
+	cases := []struct {
+		policy OverflowPolicy
+		err    error
+		want   func(stats OverflowStats) bool
+	}{
+		{OverflowBlock, ErrQueueFull, func(s OverflowStats) bool { return s.Blocked == 1 && s.BlockTimeouts == 1 }},
+		{OverflowDropNewest, ErrQueueFull, func(s OverflowStats) bool { return s.DroppedNewest == 1 }},
+		{OverflowDropOldest, nil, func(s OverflowStats) bool { return s.DroppedOldest == 1 }},
+		{OverflowDisconnect, ErrQueueFull, func(s OverflowStats) bool { return s.Disconnected == 1 }},
+	}
+
+	for _, cs := range cases {
+		srv := NewServer(
+			WithMsgProtocol(protocol.BINARY),
+			WithOutQueueSize(2),
+			WithOverflowPolicy(cs.policy, time.Millisecond*10),
+		)
+
+		conn, _ := net.Pipe()
+		channel := NewChannel(conn, "pipe", srv)
+
+		channel.EnterOutBytes([]byte("1"))
+		channel.EnterOutBytes([]byte("2"))
+		if err := channel.EnterOutBytesContext(context.Background(), []byte("3")); err != cs.err {
+			t.Errorf("%v: got %v, want %v", cs.policy, err, cs.err)
+		}
+
+		if stats := srv.OverflowStats(); !cs.want(stats) {
+			t.Errorf("%v: wrong stats %+v", cs.policy, stats)
+		}
+
+		switch cs.policy {
+		case OverflowDropOldest:
+			if data := <-channel.WaitOutBytes(); string(data) != "2" {
+				t.Errorf("%v: oldest not dropped: %s", cs.policy, data)
+			}
+		case OverflowDisconnect:
+			if channel.Alive() {
+				t.Errorf("%v: channel not closed", cs.policy)
+			}
+		}
+	}
+}
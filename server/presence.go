@@ -0,0 +1,246 @@
+package server
+
+import (
+	logger "github.com/kuhufu/cm/logger"
+	"sort"
+	"sync"
+	"time"
+)
+
+//已认证连接的在线信息
+type Presence struct {
+	RoomId        string
+	ChannelId     string
+	Network       string //tcp, ws ...
+	NodeId        string //集群模式下所在节点，单机为空
+	CreateTime    time.Time
+	LastHeartbeat time.Time //认证成功或最后一次心跳的时间
+}
+
+//同一节点上 CreateTime 相同视为同一个连接
+func (p *Presence) sameConn(o *Presence) bool {
+	return p.NodeId == o.NodeId && p.CreateTime.Equal(o.CreateTime)
+}
+
+type PresenceEventType int
+
+const (
+	PresenceOnline PresenceEventType = iota + 1
+	PresenceOffline
+)
+
+var presenceEventTypeMap = map[PresenceEventType]string{
+	PresenceOnline:  "online",
+	PresenceOffline: "offline",
+}
+
+func (t PresenceEventType) String() string {
+	return presenceEventTypeMap[t]
+}
+
+//本节点连接的上线、下线事件，同一 channel_id 被替换时先收到旧连接的 offline
+type PresenceEvent struct {
+	Type PresenceEventType
+	Presence
+}
+
+//在线状态存储，集群模式下各节点需使用同一个存储(如redis)，同一 channel_id 在不同节点上各有一条记录
+type PresenceStore interface {
+	//上线，同一节点同一 room_id + channel_id 的记录会被替换
+	Add(p Presence) error
+	//下线，仅当记录与p是同一个连接时删除，避免删除替换它的新连接
+	Remove(p Presence) error
+	//更新最后心跳时间
+	Heartbeat(roomId, channelId, nodeId string, t time.Time) error
+	//房间内的所有连接，按 CreateTime 升序
+	List(roomId string) ([]Presence, error)
+	//删除节点的所有记录，用于节点下线或重启
+	RemoveNode(nodeId string) error
+}
+
+//进程内存储，集群模式下只有多个 Server 在同一进程并共用时才能看到其他节点
+type MemoryPresence struct {
+	mu    sync.RWMutex
+	rooms map[string]map[string]*Presence //room_id -> node_id/channel_id -> presence
+}
+
+func NewMemoryPresence() *MemoryPresence {
+	return &MemoryPresence{
+		rooms: map[string]map[string]*Presence{},
+	}
+}
+
+func presenceKey(nodeId, channelId string) string {
+	return nodeId + "/" + channelId
+}
+
+func (s *MemoryPresence) Add(p Presence) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, ok := s.rooms[p.RoomId]
+	if !ok {
+		room = map[string]*Presence{}
+		s.rooms[p.RoomId] = room
+	}
+	room[presenceKey(p.NodeId, p.ChannelId)] = &p
+	return nil
+}
+
+func (s *MemoryPresence) Remove(p Presence) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room := s.rooms[p.RoomId]
+	key := presenceKey(p.NodeId, p.ChannelId)
+	if old, ok := room[key]; ok && old.sameConn(&p) {
+		delete(room, key)
+		if len(room) == 0 {
+			delete(s.rooms, p.RoomId)
+		}
+	}
+	return nil
+}
+
+func (s *MemoryPresence) Heartbeat(roomId, channelId, nodeId string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.rooms[roomId][presenceKey(nodeId, channelId)]; ok {
+		p.LastHeartbeat = t
+	}
+	return nil
+}
+
+func (s *MemoryPresence) List(roomId string) ([]Presence, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	room := s.rooms[roomId]
+	list := make([]Presence, 0, len(room))
+	for _, p := range room {
+		list = append(list, *p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].CreateTime.Before(list[j].CreateTime)
+	})
+	return list, nil
+}
+
+func (s *MemoryPresence) RemoveNode(nodeId string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for roomId, room := range s.rooms {
+		for key, p := range room {
+			if p.NodeId == nodeId {
+				delete(room, key)
+			}
+		}
+		if len(room) == 0 {
+			delete(s.rooms, roomId)
+		}
+	}
+	return nil
+}
+
+//房间内是否有连接，集群模式下包括其他节点
+func (srv *Server) IsOnline(roomId string) (bool, error) {
+	count, err := srv.CountOnline(roomId)
+	return count > 0, err
+}
+
+func (srv *Server) ListChannels(roomId string) ([]Presence, error) {
+	return srv.opts.Presence.List(roomId)
+}
+
+func (srv *Server) CountOnline(roomId string) (int, error) {
+	list, err := srv.opts.Presence.List(roomId)
+	return len(list), err
+}
+
+//集群模式下为 Broker 的节点id
+func (srv *Server) NodeId() string {
+	if srv.cluster == nil {
+		return ""
+	}
+	return srv.cluster.broker.NodeId()
+}
+
+func (srv *Server) presenceOf(channel *Channel) Presence {
+	return Presence{
+		RoomId:        channel.RoomId(),
+		ChannelId:     channel.Id(),
+		Network:       channel.Network,
+		NodeId:        srv.NodeId(),
+		CreateTime:    channel.CreateTime,
+		LastHeartbeat: time.Now(),
+	}
+}
+
+//连接的在线状态，保证下线总在上线之后处理
+type presenceState int
+
+const (
+	presenceNone    presenceState = iota
+	presenceAdding                //正在上线
+	presenceClosing               //上线过程中连接关闭，上线完成后再下线
+	presenceOnline
+	presenceOffline
+)
+
+func (srv *Server) presenceOnline(channel *Channel) {
+	channel.presenceMu.Lock()
+	//连接已关闭，OnClose 已经或即将处理下线，不再上线
+	if channel.presenceState != presenceNone || !channel.Alive() {
+		channel.presenceMu.Unlock()
+		return
+	}
+	channel.presenceState = presenceAdding
+	channel.presenceMu.Unlock()
+
+	p := srv.presenceOf(channel)
+	if err := srv.opts.Presence.Add(p); err != nil {
+		logger.Errorf("%v, presence add error: %v", channel, err)
+	}
+	srv.emitPresence(PresenceOnline, p)
+
+	channel.presenceMu.Lock()
+	closing := channel.presenceState == presenceClosing
+	channel.presenceState = presenceOnline
+	channel.presenceMu.Unlock()
+
+	if closing {
+		srv.presenceOffline(channel)
+	}
+}
+
+func (srv *Server) presenceOffline(channel *Channel) {
+	channel.presenceMu.Lock()
+	if channel.presenceState == presenceAdding { //不阻塞，OnPresence 中可能关闭连接
+		channel.presenceState = presenceClosing
+		channel.presenceMu.Unlock()
+		return
+	}
+	channel.presenceState = presenceOffline
+	channel.presenceMu.Unlock()
+
+	p := srv.presenceOf(channel)
+	if err := srv.opts.Presence.Remove(p); err != nil {
+		logger.Errorf("%v, presence remove error: %v", channel, err)
+	}
+	srv.emitPresence(PresenceOffline, p)
+}
+
+func (srv *Server) presenceHeartbeat(channel *Channel) {
+	err := srv.opts.Presence.Heartbeat(channel.RoomId(), channel.Id(), srv.NodeId(), time.Now())
+	if err != nil {
+		logger.Errorf("%v, presence heartbeat error: %v", channel, err)
+	}
+}
+
+func (srv *Server) emitPresence(typ PresenceEventType, p Presence) {
+	if srv.opts.OnPresence != nil {
+		srv.opts.OnPresence(PresenceEvent{Type: typ, Presence: p})
+	}
+}
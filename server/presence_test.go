@@ -0,0 +1,165 @@
+package server
+
+import (
+	"github.com/kuhufu/cm/cluster"
+	"github.com/kuhufu/cm/protocol"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMemoryPresence(t *testing.T) {
+	store := NewMemoryPresence()
+	now := time.Now()
+
+	old := Presence{RoomId: "1", ChannelId: "web", NodeId: "node1", CreateTime: now}
+	store.Add(old)
+	store.Add(Presence{RoomId: "1", ChannelId: "web", NodeId: "node2", CreateTime: now.Add(time.Second)})
+
+	//同一节点的新连接替换旧连接，旧连接的 Remove 不影响新连接
+	cur := Presence{RoomId: "1", ChannelId: "web", NodeId: "node1", CreateTime: now.Add(time.Second * 2)}
+	store.Add(cur)
+	store.Remove(old)
+
+	list, _ := store.List("1")
+	if len(list) != 2 || list[0].NodeId != "node2" || !list[1].CreateTime.Equal(cur.CreateTime) {
+		t.Fatalf("wrong list: %v", list)
+	}
+
+	heartbeat := now.Add(time.Minute)
+	store.Heartbeat("1", "web", "node1", heartbeat)
+	list, _ = store.List("1")
+	if !list[1].LastHeartbeat.Equal(heartbeat) {
+		t.Errorf("heartbeat not updated: %v", list[1])
+	}
+
+	store.RemoveNode("node2")
+	if list, _ := store.List("1"); len(list) != 1 || list[0].NodeId != "node1" {
+		t.Errorf("wrong list after remove node: %v", list)
+	}
+
+	store.Remove(cur)
+	if list, _ := store.List("1"); len(list) != 0 {
+		t.Errorf("room should be empty: %v", list)
+	}
+}
+
+func TestPresence(t *testing.T) {
+	hub := cluster.NewLocalHub()
+	presence := NewMemoryPresence()
+	events := make(chan PresenceEvent, 8)
+
+	var servers []*Server
+	var addrs []string
+	for _, nodeId := range []string{"node1", "node2"} {
+		srv, addr := runServer(t, "tcp",
+			WithCluster(hub.NewBroker(nodeId)),
+			WithPresence(presence, func(event PresenceEvent) {
+				events <- event
+			}),
+		)
+		defer srv.Close()
+
+		servers = append(servers, srv)
+		addrs = append(addrs, addr)
+	}
+
+	expect := func(typ PresenceEventType, nodeId string) {
+		select {
+		case event := <-events:
+			if event.Type != typ || event.NodeId != nodeId || event.RoomId != "7" {
+				t.Errorf("wrong event: %v %+v", event.Type, event.Presence)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v event timeout", typ)
+		}
+	}
+
+	c1 := dial(t, addrs[0], "7:web")
+	expect(PresenceOnline, "node1")
+
+	c2 := dial(t, addrs[1], "7:app")
+	defer c2.Close()
+	expect(PresenceOnline, "node2")
+
+	//共用存储，任一节点都能查到所有节点的连接
+	list, err := servers[1].ListChannels("7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0].ChannelId != "web" || list[0].NodeId != "node1" || list[0].Network != "tcp" {
+		t.Fatalf("wrong channels: %+v", list)
+	}
+
+	c1.Close()
+	expect(PresenceOffline, "node1")
+
+	if count, _ := servers[0].CountOnline("7"); count != 1 {
+		t.Errorf("wrong count: %v", count)
+	}
+	if online, _ := servers[0].IsOnline("8"); online {
+		t.Error("room 8 should be offline")
+	}
+}
+
+func TestPresence_Closed(t *testing.T) {
+	presence := NewMemoryPresence()
+	events := make(chan PresenceEvent, 8)
+	srv := NewServer(WithMsgProtocol(protocol.BINARY), WithPresence(presence, func(event PresenceEvent) {
+		events <- event
+	}))
+
+	//认证过程中连接已关闭，OnClose 已经下线
+	conn, _ := net.Pipe()
+	channel := newChannel(conn, "tcp", srv, &srv.opts)
+	channel.Init("9", "web")
+	channel.OnClose = func() {
+		srv.presenceOffline(channel)
+	}
+	channel.Close()
+	srv.presenceOnline(channel)
+
+	if event := <-events; event.Type != PresenceOffline {
+		t.Errorf("wrong event: %v", event.Type)
+	}
+	select {
+	case event := <-events:
+		t.Errorf("unexpected event: %v", event.Type)
+	default:
+	}
+	if list, _ := presence.List("9"); len(list) != 0 {
+		t.Errorf("stale presence: %+v", list)
+	}
+}
+
+func TestPresence_KickOnOnline(t *testing.T) {
+	presence := NewMemoryPresence()
+	events := make(chan PresenceEvent, 8)
+
+	var srv *Server
+	srv, addr := runServer(t, "tcp", WithPresence(presence, func(event PresenceEvent) {
+		events <- event
+		//回调中关闭连接，下线在上线之后处理
+		if event.Type == PresenceOnline {
+			srv.Kick(event.RoomId, event.ChannelId, nil)
+		}
+	}))
+	defer srv.Close()
+
+	c := dial(t, addr, "10")
+	defer c.Close()
+
+	for _, want := range []PresenceEventType{PresenceOnline, PresenceOffline} {
+		select {
+		case event := <-events:
+			if event.Type != want {
+				t.Fatalf("wrong event: %v, want %v", event.Type, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("%v event timeout", want)
+		}
+	}
+	if list, _ := presence.List("10"); len(list) != 0 {
+		t.Errorf("stale presence: %+v", list)
+	}
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"context"
+	"github.com/kuhufu/cm/protocol/consts"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	logger "github.com/kuhufu/cm/logger"
+)
+
+//可靠推送配置
+//开启后 CmdServerPush 消息的 RequestId 为每个 room_id + channel_id 独立递增的序号，
+//客户端收到后需回复相同 RequestId 的 CmdAck，未确认的消息定时重发，同一 channel_id 重连后重放。
+//消息至少送达一次，客户端需要按序号去重，client 包已经去重。
+//会话的起始序号是随机的，会话过期后重新创建的会话不会重复使用刚用过的序号
+//推送时同样按 Options.OverflowPolicy 处理，被丢弃的消息仍在未确认列表中，之后重发；
+//重发不等待队列，队列满时放弃本次重发，仍计入重发次数
+type ReliableOptions struct {
+	//重发间隔，默认5s
+	RetransmitInterval time.Duration
+	//最大重发次数，默认3
+	MaxRetries int
+	//连接断开后保留未确认消息的时间，超时后消息视为失败，默认60s
+	SessionTimeout time.Duration
+	//消息最终发送失败
+	OnFailed func(roomId, channelId string, data []byte)
+}
+
+func (o *ReliableOptions) init() {
+	if o.RetransmitInterval <= 0 {
+		o.RetransmitInterval = time.Second * 5
+	}
+	if o.MaxRetries <= 0 {
+		o.MaxRetries = 3
+	}
+	if o.SessionTimeout <= 0 {
+		o.SessionTimeout = time.Second * 60
+	}
+}
+
+type pendingPush struct {
+	seq     uint32
+	data    []byte
+	retries int
+	sentAt  time.Time
+}
+
+//同一 room_id + channel_id 的推送状态，重连后继续使用
+type reliableSession struct {
+	mu          sync.Mutex
+	roomId      string
+	channelId   string
+	seq         uint32
+	start       uint32 //起始序号，序号可能回绕，按与它的距离排序
+	pending     map[uint32]*pendingPush
+	channel     *Channel //当前连接，断开时为nil
+	expireTimer *time.Timer
+}
+
+type reliable struct {
+	opts     ReliableOptions
+	mu       sync.Mutex
+	sessions map[string]*reliableSession
+	rand     *rand.Rand //起始序号，mu 保护
+}
+
+func newReliable(opts ReliableOptions) *reliable {
+	opts.init()
+	return &reliable{
+		opts:     opts,
+		sessions: map[string]*reliableSession{},
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func sessionKey(roomId, channelId string) string {
+	return roomId + "/" + channelId
+}
+
+func (r *reliable) getOrCreate(roomId, channelId string) *reliableSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := sessionKey(roomId, channelId)
+	if s, ok := r.sessions[key]; ok {
+		return s
+	}
+
+	start := r.rand.Uint32()
+	s := &reliableSession{
+		roomId:    roomId,
+		channelId: channelId,
+		seq:       start,
+		start:     start,
+		pending:   map[uint32]*pendingPush{},
+	}
+	r.sessions[key] = s
+	return s
+}
+
+//连接认证成功，重放未确认的消息
+func (r *reliable) attach(channel *Channel) {
+	s := r.getOrCreate(channel.RoomId(), channel.Id())
+
+	s.mu.Lock()
+	s.channel = channel
+	if s.expireTimer != nil {
+		s.expireTimer.Stop()
+		s.expireTimer = nil
+	}
+
+	now := time.Now()
+	replay := s.sortedPending()
+	for _, p := range replay {
+		p.sentAt = now
+	}
+	s.mu.Unlock()
+
+	//不持有锁发送，避免队列满时阻塞ack，最多等待一个重发间隔，没能进入队列的消息之后重发
+	ctx, cancel := context.WithTimeout(context.Background(), r.opts.RetransmitInterval)
+	defer cancel()
+
+	for _, p := range replay {
+		if err := channel.enterOutBytesWait(ctx, encodeReliablePush(channel, p.seq, p.data)); err != nil {
+			logger.Debugf("%v, replay reliable push error: %v", channel, err)
+			break
+		}
+	}
+}
+
+//连接关闭，SessionTimeout 内没有重连则丢弃会话
+func (r *reliable) detach(channel *Channel) {
+	s := r.getOrCreate(channel.RoomId(), channel.Id())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.channel != channel {
+		return
+	}
+
+	s.channel = nil
+	s.expireTimer = time.AfterFunc(r.opts.SessionTimeout, func() {
+		r.expire(s)
+	})
+}
+
+func (r *reliable) expire(s *reliableSession) {
+	r.mu.Lock()
+	s.mu.Lock()
+	if s.channel != nil {
+		s.mu.Unlock()
+		r.mu.Unlock()
+		return
+	}
+	delete(r.sessions, sessionKey(s.roomId, s.channelId))
+	pending := s.sortedPending()
+	s.pending = map[uint32]*pendingPush{}
+	s.mu.Unlock()
+	r.mu.Unlock()
+
+	for _, p := range pending {
+		r.fail(s, p)
+	}
+}
+
+//未能进入发送队列的消息仍会定时重发
+func (r *reliable) push(ctx context.Context, channel *Channel, data []byte) error {
+	p, channel := r.add(channel, data)
+	if channel == nil { //等待重连后重放
+		return nil
+	}
+	return channel.EnterOutBytesContext(ctx, encodeReliablePush(channel, p.seq, data))
+}
+
+//只加入未确认列表，返回会话的当前连接
+func (r *reliable) add(channel *Channel, data []byte) (*pendingPush, *Channel) {
+	s := r.getOrCreate(channel.RoomId(), channel.Id())
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	if s.seq == 0 { //0 表示不需要确认
+		s.seq++
+	}
+	p := &pendingPush{
+		seq:    s.seq,
+		data:   data,
+		sentAt: time.Now(),
+	}
+	s.pending[p.seq] = p
+	return p, s.channel
+}
+
+func (r *reliable) ack(channel *Channel, seq uint32) {
+	s := r.getOrCreate(channel.RoomId(), channel.Id())
+
+	s.mu.Lock()
+	delete(s.pending, seq)
+	s.mu.Unlock()
+}
+
+//每个连接的序号不同，无法复用encode结果
+func encodeReliablePush(channel *Channel, seq uint32, data []byte) []byte {
+	factory := channel.MsgFactory()
+	msg := factory.GetPoolMsg().SetBody(data).SetCmd(consts.CmdServerPush).SetRequestId(seq)
+	data = msg.Encode()
+	factory.FreePoolMsg(msg)
+
+	return data
+}
+
+func (r *reliable) fail(s *reliableSession, p *pendingPush) {
+	logger.Debugf("reliable push failed, room_id: %v, channel_id: %v, seq: %v", s.roomId, s.channelId, p.seq)
+
+	if r.opts.OnFailed != nil {
+		r.opts.OnFailed(s.roomId, s.channelId, p.data)
+	}
+}
+
+//定时重发超时未确认的消息
+func (r *reliable) run(exitC <-chan struct{}) {
+	ticker := time.NewTicker(r.opts.RetransmitInterval / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-exitC:
+			return
+		case now := <-ticker.C:
+			r.mu.Lock()
+			sessions := make([]*reliableSession, 0, len(r.sessions))
+			for _, s := range r.sessions {
+				sessions = append(sessions, s)
+			}
+			r.mu.Unlock()
+
+			for _, s := range sessions {
+				r.retransmit(s, now)
+			}
+		}
+	}
+}
+
+func (r *reliable) retransmit(s *reliableSession, now time.Time) {
+	var failed, resend []*pendingPush
+
+	s.mu.Lock()
+	channel := s.channel
+	if channel == nil { //等待重连
+		s.mu.Unlock()
+		return
+	}
+
+	for _, p := range s.sortedPending() {
+		if now.Sub(p.sentAt) < r.opts.RetransmitInterval {
+			continue
+		}
+
+		if p.retries >= r.opts.MaxRetries {
+			delete(s.pending, p.seq)
+			failed = append(failed, p)
+			continue
+		}
+
+		p.retries++
+		p.sentAt = now
+		resend = append(resend, p)
+	}
+	s.mu.Unlock()
+
+	//在全局的重发goroutine中执行，不能等待慢连接
+	for _, p := range resend {
+		if err := channel.tryEnterOutBytes(encodeReliablePush(channel, p.seq, p.data)); err != nil {
+			logger.Debugf("%v, retransmit reliable push error: %v", channel, err)
+			break
+		}
+	}
+
+	for _, p := range failed {
+		r.fail(s, p)
+	}
+}
+
+func (s *reliableSession) sortedPending() []*pendingPush {
+	list := make([]*pendingPush, 0, len(s.pending))
+	for _, p := range s.pending {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].seq-s.start < list[j].seq-s.start
+	})
+	return list
+}
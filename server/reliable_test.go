@@ -0,0 +1,135 @@
+package server
+
+import (
+	"github.com/kuhufu/cm/protocol"
+	"github.com/kuhufu/cm/protocol/consts"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReliablePush(t *testing.T) {
+	failedC := make(chan string, 1)
+	srv, addr := runServer(t, "tcp",
+		WithReliablePush(ReliableOptions{
+			RetransmitInterval: time.Millisecond * 20,
+			MaxRetries:         2,
+			OnFailed: func(roomId, channelId string, data []byte) {
+				failedC <- string(data)
+			},
+		}),
+	)
+	defer srv.Close()
+
+	//客户端自动确认
+	c := dial(t, addr, "5:web")
+	defer c.Close()
+
+	//不确认的连接
+	conn, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	factory := protocol.GetFactory(protocol.BINARY)
+	msg := factory.NewDefaultMessage().SetCmd(consts.CmdAuth).SetRequestId(1).SetBody([]byte("5:ios"))
+	if _, err := msg.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msg.ReadFrom(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	srv.Unicast([]byte("push"), "5")
+
+	expectPush(t, c.Push(), "push")
+
+	//第一次发送 + 2次重发，序号相同
+	var seq uint32
+	for i := 0; i < 3; i++ {
+		if _, err := msg.ReadFrom(conn); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			seq = msg.RequestId()
+		}
+		if msg.Cmd() != consts.CmdServerPush || msg.RequestId() == 0 || msg.RequestId() != seq {
+			t.Errorf("wrong push: %v", msg)
+		}
+	}
+
+	select {
+	case data := <-failedC:
+		if data != "push" {
+			t.Errorf("wrong failed data: %v", data)
+		}
+	case <-time.After(time.Second):
+		t.Error("OnFailed not called")
+	}
+}
+
+//不读取的慢连接不阻塞推送和其他连接的重发
+func TestReliablePush_SlowChannel(t *testing.T) {
+	srv, addr := runServer(t, "tcp",
+		WithReliablePush(ReliableOptions{
+			RetransmitInterval: time.Millisecond * 20,
+			MaxRetries:         100,
+		}),
+		WithOverflowPolicy(OverflowDropNewest, 0),
+	)
+	defer srv.Close()
+
+	factory := protocol.GetFactory(protocol.BINARY)
+	auth := func(token string) net.Conn {
+		conn, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := factory.NewDefaultMessage().SetCmd(consts.CmdAuth).SetRequestId(1).SetBody([]byte(token))
+		if _, err := msg.WriteTo(conn); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := msg.ReadFrom(conn); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	slow := auth("26")
+	defer slow.Close()
+
+	//超过socket缓冲区，发送队列一直是满的
+	done := make(chan struct{})
+	go func() {
+		data := make([]byte, 256*1024)
+		for i := 0; i < 64; i++ {
+			srv.Unicast(data, "26")
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("push blocked by slow channel")
+	}
+
+	conn := auth("27")
+	defer conn.Close()
+
+	srv.Unicast([]byte("push"), "27")
+
+	//第一次发送 + 重发
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for i := 0; i < 3; i++ {
+		msg := factory.NewDefaultMessage()
+		if _, err := msg.ReadFrom(conn); err != nil {
+			t.Fatalf("retransmit blocked: %v", err)
+		}
+		if string(msg.Body()) != "push" {
+			t.Errorf("wrong push: %s", msg.Body())
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package server
 
 import (
+	"context"
 	"sync"
+	"time"
 )
 
 type Room struct {
@@ -83,6 +85,7 @@ func (c *Room) Range(f func(id string, channel *Channel) bool) {
 	c.mu.RLock()
 	size := len(c.members)
 	if size == 0 {
+		c.mu.RUnlock()
 		return
 	}
 
@@ -102,38 +105,41 @@ func (c *Room) Range(f func(id string, channel *Channel) bool) {
 	}
 }
 
+//data 与 Server.Unicast 一样作为 CmdServerPush 的body按连接的协议编码，计入推送统计
 func (c *Room) Unicast(data []byte, id string, filters ...ChannelFilter) {
-	if channel, ok := c.Get(id); ok {
-		for _, filter := range filters {
-			if !filter(channel) {
-				return
-			}
-		}
-		channel.EnterOutBytes(data)
-	}
+	c.Multicast(data, []string{id}, filters...)
 }
 
 func (c *Room) Multicast(data []byte, ids []string, filters ...ChannelFilter) {
+	channels := make([]*Channel, 0, len(ids))
 	for _, id := range ids {
 		if channel, ok := c.Get(id); ok {
-			for _, filter := range filters {
-				if !filter(channel) {
-					return
-				}
-			}
-			channel.EnterOutBytes(data)
+			channels = append(channels, channel)
 		}
 	}
+	c.push(data, channels, filters...)
 }
 
 func (c *Room) Broadcast(data []byte, filters ...ChannelFilter) {
+	var channels []*Channel
 	c.Range(func(id string, channel *Channel) bool {
-		for _, filter := range filters {
-			if !filter(channel) {
-				return true
-			}
-		}
-		channel.EnterOutBytes(data)
+		channels = append(channels, channel)
 		return true
 	})
+	c.push(data, channels, filters...)
+}
+
+func (c *Room) push(data []byte, channels []*Channel, filters ...ChannelFilter) {
+	if len(channels) == 0 {
+		return
+	}
+
+	srv := channels[0].srv
+	var report DeliveryReport
+	encoder := newPushEncoder(data)
+	defer srv.metrics.observePush(time.Now(), &report)
+
+	for _, channel := range channels {
+		srv.deliver(context.Background(), channel, encoder, &report, filters...)
+	}
 }
@@ -66,6 +66,7 @@ func (m *Manager) Range(f func(key string, val *Room) bool) {
 	m.mu.RLock()
 	size := len(m.rooms)
 	if size == 0 {
+		m.mu.RUnlock()
 		return
 	}
 
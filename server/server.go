@@ -1,12 +1,15 @@
 package server
 
 import (
-	"errors"
+	"context"
 	"fmt"
 	"github.com/kuhufu/cm/protocol"
 	"github.com/kuhufu/cm/protocol/Interface"
 	"github.com/kuhufu/cm/protocol/consts"
+	"hash/fnv"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	logger "github.com/kuhufu/cm/logger"
@@ -17,30 +20,157 @@ type Server struct {
 	opts        Options
 	mu          sync.Mutex
 	allChannels sync.Map //方便广播
+	channels    sync.Map //所有连接，包括未认证的
+	listeners   map[net.Listener]struct{}
+	serveWg     sync.WaitGroup //等待所有连接的 OnClose 执行完成
 	exitC       chan struct{}
+	exitOnce    sync.Once
+	reliable    *reliable
+	async       *workerPool
+	storeLocks  [32]sync.RWMutex //离线消息按房间分段加锁
+	loginLocks  loginLocks       //同一房间的登录串行执行
+	topics      *topicManager
+	cmdHandlers sync.Map //自定义命令
+	cluster     *clusterNode
+	clusterOnce sync.Once
+	clusterErr  error
+
+	overflowStats OverflowStats
+	closeStats    [closeReasonCount]uint64
+	metrics       *serverMetrics
+	bans          *banList
 }
 
 func NewServer(opts ...Option) *Server {
 	s := &Server{
-		cm:    NewManager(),
-		opts:  defaultOptions(),
-		exitC: make(chan struct{}),
+		cm:        NewManager(),
+		topics:    newTopicManager(),
+		bans:      newBanList(),
+		opts:      defaultOptions(),
+		listeners: map[net.Listener]struct{}{},
+		exitC:     make(chan struct{}),
 	}
+	s.metrics = newServerMetrics(s)
 
 	for _, opt := range opts {
 		opt(&s.opts)
 	}
 
+	if s.opts.Reliable != nil {
+		s.reliable = newReliable(*s.opts.Reliable)
+		go s.reliable.run(s.exitC)
+	}
+
+	if s.opts.Async != nil {
+		s.async = newWorkerPool(*s.opts.Async)
+		s.async.run()
+	}
+
+	if s.opts.Broker != nil {
+		s.cluster = newClusterNode(s, s.opts.Broker)
+	}
+
 	logger.Printf("auth_timeout: %v, heartbeat_timeout: %v", s.opts.AuthTimeout, s.opts.HeartbeatTimeout)
 
 	return s
 }
 
+//立即关闭所有监听和连接
 func (srv *Server) Close() error {
-	close(srv.exitC)
+	srv.stop()
+
+	srv.channels.Range(func(key, value interface{}) bool {
+		key.(*Channel).CloseWithReason(CloseShutdown)
+		return true
+	})
 	return nil
 }
 
+//优雅关闭：停止监听，等待已排队的异步请求处理完，向已认证的连接发送 CmdClose，待发送的消息写完后关闭连接，
+//等待所有连接的 OnClose 执行完成。ctx 结束时强制关闭剩余连接并返回 ctx.Err()
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.stop()
+
+	//异步请求的回复在 CmdClose 之前写入
+	if srv.async != nil {
+		asyncDoneC := make(chan struct{})
+		go func() {
+			srv.async.wait()
+			close(asyncDoneC)
+		}()
+
+		select {
+		case <-asyncDoneC:
+		case <-ctx.Done():
+			srv.Close()
+			return ctx.Err()
+		}
+	}
+
+	srv.channels.Range(func(key, value interface{}) bool {
+		channel := key.(*Channel)
+		if channel.Id() == "" { //未认证
+			channel.CloseWithReason(CloseShutdown)
+		} else {
+			channel.Drain(buildCloseMessage(channel.MsgFactory(), channel.opts.ShutdownReason))
+		}
+		return true
+	})
+
+	doneC := make(chan struct{})
+	go func() {
+		srv.serveWg.Wait()
+		close(doneC)
+	}()
+
+	select {
+	case <-doneC:
+		return nil
+	case <-ctx.Done():
+		srv.Close()
+		return ctx.Err()
+	}
+}
+
+//停止接收新连接
+func (srv *Server) stop() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	srv.exitOnce.Do(func() {
+		close(srv.exitC)
+	})
+
+	for ln := range srv.listeners {
+		ln.Close()
+	}
+
+	if srv.async != nil {
+		srv.async.stop()
+	}
+
+	//其他节点不再转发到本节点
+	if srv.cluster != nil {
+		srv.cluster.close()
+	}
+}
+
+//第一次监听时加入集群
+func (srv *Server) startCluster() error {
+	if srv.cluster == nil {
+		return nil
+	}
+
+	srv.clusterOnce.Do(func() {
+		//清除本节点上次运行留下的在线记录
+		if err := srv.opts.Presence.RemoveNode(srv.NodeId()); err != nil {
+			logger.Errorf("presence remove node error: %v", err)
+		}
+		srv.clusterErr = srv.cluster.start()
+	})
+	return srv.clusterErr
+}
+
 func (srv *Server) AddHandler(handler Handler) {
 	if handler == nil {
 		panic("message opts.Handler cannot be nil")
@@ -65,14 +195,85 @@ func (srv *Server) optsCopy(opts ...Option) Options {
 	return optCpy
 }
 
+//监听地址及只作用于该地址的配置
+type Endpoint struct {
+	Addr string
+	Opts []Option
+}
+
+//同时监听多个地址，所有连接共用一个房间管理器
+//任一地址监听失败时关闭已创建的监听并返回错误，否则阻塞直到所有监听退出，返回第一个错误
+func (srv *Server) RunAll(endpoints ...Endpoint) error {
+	listeners := make([]*listener, 0, len(endpoints))
+	for _, endpoint := range endpoints {
+		l, err := srv.listen(endpoint.Addr, endpoint.Opts...)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, l)
+	}
+
+	errC := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l *listener) {
+			errC <- srv.serveListener(l)
+		}(l)
+	}
+
+	var err error
+	for range listeners {
+		if e := <-errC; err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
 func (srv *Server) Run(addr string, opts ...Option) error {
+	l, err := srv.listen(addr, opts...)
+	if err != nil {
+		return err
+	}
+
+	return srv.serveListener(l)
+}
+
+type listener struct {
+	net.Listener
+	addr string
+	opts Options
+}
+
+func (srv *Server) listen(addr string, opts ...Option) (*listener, error) {
+	if err := srv.startCluster(); err != nil {
+		return nil, err
+	}
+
 	opt := srv.optsCopy(opts...)
 	ln, err := getListener(addr, opt)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	return &listener{
+		Listener: ln,
+		addr:     addr,
+		opts:     opt,
+	}, nil
+}
+
+func (srv *Server) serveListener(l *listener) error {
+	ln, addr := l.Listener, l.addr
+	if !srv.trackListener(ln, true) {
+		ln.Close()
+		return ErrServerClosed
 	}
 
 	defer func() {
+		srv.trackListener(ln, false)
 		ln.Close()
 		logger.Infof("listener %v://%v exit", ln.Addr().Network(), ln.Addr().String())
 	}()
@@ -81,29 +282,66 @@ func (srv *Server) Run(addr string, opts ...Option) error {
 
 	network := ln.Addr().Network()
 	for {
-		if srv.exiting() {
-			return errors.New("listener exit")
-		}
-
 		conn, err := ln.Accept()
 		if err != nil {
+			if srv.exiting() {
+				return ErrServerClosed
+			}
 			return err
 		}
 
 		logger.Printf("new connect: %v->%v", conn.RemoteAddr(), conn.LocalAddr())
+		srv.metrics.accepted.Inc()
+
+		channel := newChannel(srv.metrics.wrapConn(conn), network, srv, &l.opts)
+		if !srv.trackChannel(channel) {
+			conn.Close()
+			return ErrServerClosed
+		}
 
 		go func() {
 			defer func() {
 				if err := recover(); err != nil {
 					logger.Error(err)
 				}
-
+				srv.channels.Delete(channel)
+				srv.serveWg.Done()
 			}()
-			srv.serve(NewChannel(conn, network, srv))
+			srv.serve(channel)
 		}()
 	}
 }
 
+func (srv *Server) trackListener(ln net.Listener, add bool) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if !add {
+		delete(srv.listeners, ln)
+		return true
+	}
+
+	if srv.exiting() {
+		return false
+	}
+	srv.listeners[ln] = struct{}{}
+	return true
+}
+
+//关闭后不再接收新连接，加锁保证 serveWg.Add 不会和 Shutdown 里的 Wait 并发
+func (srv *Server) trackChannel(channel *Channel) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	if srv.exiting() {
+		return false
+	}
+
+	srv.serveWg.Add(1)
+	srv.channels.Store(channel, nil)
+	return true
+}
+
 func (srv *Server) exiting() bool {
 	select {
 	case <-srv.exitC:
@@ -116,48 +354,83 @@ func (srv *Server) exiting() bool {
 
 func (srv *Server) serve(channel *Channel) {
 	var err error
+	var readErr error //认证之后读goroutine退出的原因，readLoop 已记录日志
+	var reason CloseReason
 	defer func() {
 		if err != nil {
 			logger.Error(err)
 		}
-		channel.Close()
-		srv.opts.Handler.OnClose(channel)
+		channel.CloseWithReason(reason)
+		srv.unsubscribeAll(channel)
+		if err == nil {
+			err = readErr
+		}
+		logger.Printf("%v, closed: %v", channel, channel.CloseReason())
+		srv.onDisconnect(channel, channel.CloseReason(), err)
+		channel.opts.Handler.OnClose(channel)
 	}()
 
+	if err = srv.onConnect(channel); err != nil {
+		reason = CloseRejected
+		close(channel.writerDoneC)
+		return
+	}
+
 	go srv.writeLoop(channel)
 
-	AuthTimer := time.AfterFunc(srv.opts.AuthTimeout, func() {
-		channel.Close()
+	authDeadline := time.Now().Add(channel.opts.AuthTimeout)
+	AuthTimer := time.AfterFunc(channel.opts.AuthTimeout, func() {
+		channel.CloseWithReason(CloseAuthTimeout)
 		logger.Println("auth timeout")
 	})
 
-	factory := srv.GetMsgFactory()
+	factory := channel.MsgFactory()
+	auth := chainAuth(channel.opts.AuthInterceptors, srv.onAuth)
 	msg := factory.NewMessage()
 	for {
 		if srv.exiting() {
+			reason = CloseShutdown
 			return
 		}
 
-		if _, err := msg.ReadFrom(channel.Conn); err != nil {
-			logger.Error(err)
+		if _, err = msg.ReadFrom(channel.Conn); err != nil {
+			reason = readCloseReason(err)
 			return
 		}
 
 		logger.Debugf("receive message: %v", msg)
+		srv.metrics.messageIn(msg.Cmd())
 
 		switch msg.Cmd() {
 		case consts.CmdAuth:
-			reply := srv.opts.Handler.OnAuth(msg.Body())
-
-			if err = reply.err; err != nil {
-				return
+			channel.supportsCode = supportsCode(msg)
+
+			reply, authErr := auth(channel, msg)
+			if authErr != nil {
+				srv.metrics.auth.With("error").Inc()
+				srv.onAuthFailed(channel, msg.Body(), authErr)
+				channel.EnterOutMsg(buildErrorMessage(channel, msg, authErr))
+				continue
+			}
+			if reply == nil { //拦截器短路时没有回复，按认证失败处理
+				reply = &AuthReply{}
 			}
 
-			channel.EnterOutMsg(srv.BuildReplyMessage(msg, reply.Data))
+			replyMsg := buildReplyMessage(factory, msg, reply.Data)
+
+			if reply.Ok && srv.Banned(reply.RoomId, reply.ChannelId) {
+				factory.FreePoolMsg(replyMsg)
+				srv.metrics.auth.With("banned").Inc()
+				srv.onAuthFailed(channel, msg.Body(), ErrBanned)
+				channel.EnterOutMsg(buildErrorMessage(channel, msg, ErrBanned))
+				continue
+			}
 
 			if reply.Ok {
 				if !AuthTimer.Stop() {
+					factory.FreePoolMsg(replyMsg)
 					err = ErrAuthTimeout
+					reason = CloseAuthTimeout
 					return
 				}
 
@@ -166,21 +439,38 @@ func (srv *Server) serve(channel *Channel) {
 					channel.Metadata.Store(k, v)
 				}
 
-				srv.addChannel(channel, reply.RoomId, reply.ChannelId)
+				if err := srv.addChannel(channel, reply.RoomId, reply.ChannelId, replyMsg); err != nil {
+					factory.FreePoolMsg(replyMsg)
+					AuthTimer.Reset(time.Until(authDeadline)) //只恢复剩余时间，被拒绝的连接不能一直重试
+					srv.metrics.auth.With("rejected").Inc()
+					srv.onAuthFailed(channel, msg.Body(), err)
+					channel.EnterOutMsg(buildErrorMessage(channel, msg, err))
+					continue
+				}
+				srv.metrics.auth.With("ok").Inc()
 				goto authOk
 			}
+
+			//认证失败，回复 CodeUnauthorized，连接可以继续认证
+			srv.metrics.auth.With("failed").Inc()
+			srv.onAuthFailed(channel, msg.Body(), nil)
+			if channel.supportsCode {
+				replyMsg.SetCode(consts.CodeUnauthorized)
+			}
+			channel.EnterOutMsg(replyMsg)
 		default:
 			err = fmt.Errorf("new connection must authentication %v", msg.Cmd())
+			reason = CloseProtocolError
 			return
 		}
 	}
 authOk:
-	srv.readLoop(channel)
+	readErr = srv.readLoop(channel)
 }
 
-func (srv *Server) readLoop(channel *Channel) {
-	var err error
+func (srv *Server) readLoop(channel *Channel) (err error) {
 	var heartbeatTimer *time.Timer
+	reason := CloseClient
 
 	defer func() { //在defer里面关闭连接
 		heartbeatTimer.Stop()
@@ -189,149 +479,348 @@ func (srv *Server) readLoop(channel *Channel) {
 		} else {
 			logger.Printf("%v, reader exit", channel, channel.CreateTime)
 		}
+		channel.CloseWithReason(reason)
 	}()
 
-	heartbeatTimer = time.AfterFunc(srv.opts.HeartbeatTimeout, func() {
-		channel.Close()
+	heartbeatTimer = time.AfterFunc(channel.opts.HeartbeatTimeout, func() {
+		channel.CloseWithReason(CloseHeartbeatTimeout)
 		logger.Println("first heartbeat timeout")
 	})
 
-	factory := srv.GetMsgFactory()
+	factory := channel.MsgFactory()
+	receive := chainReceive(channel.opts.ReceiveInterceptors, srv.onReceive)
 	msg := factory.NewMessage()
 
-	for {
-		if srv.exiting() {
-			return
-		}
+	var ac *asyncChannel
+	if srv.async != nil {
+		ac = srv.newAsyncChannel()
+	}
 
+	//服务关闭时由writer关闭连接，reader不主动退出，避免丢弃未写完的消息
+	for {
 		if _, err = msg.ReadFrom(channel.Conn); err != nil {
+			reason = readCloseReason(err)
 			return
 		}
 
-		logger.Debugf("channel_id: %v, msg: %s", channel.id, msg)
+		logger.Debugf("channel_id: %v, msg: %s", channel.Id(), msg)
+		srv.metrics.messageIn(msg.Cmd())
 
 		switch msg.Cmd() {
-		case consts.CmdPush:
-			data := srv.opts.Handler.OnReceive(channel, msg.Body())
-			channel.EnterOutMsg(srv.BuildReplyMessage(msg, data))
 		case consts.CmdHeartbeat:
 			if !heartbeatTimer.Stop() {
 				err = ErrHeartbeatTimeout
+				reason = CloseHeartbeatTimeout
 				return
 			}
-			heartbeatTimer.Reset(srv.opts.HeartbeatTimeout)
-			channel.EnterOutMsg(srv.BuildReplyMessage(msg, nil))
+			heartbeatTimer.Reset(channel.opts.HeartbeatTimeout)
+			srv.presenceHeartbeat(channel)
+			srv.onHeartbeat(channel)
+			channel.EnterOutMsg(buildReplyMessage(factory, msg, nil))
+		case consts.CmdAck:
+			if srv.reliable != nil {
+				srv.reliable.ack(channel, msg.RequestId())
+			}
+		case consts.CmdSubscribe:
+			//成功时回复空body，失败时回复错误信息和状态码
+			if err := srv.clientSubscribe(channel, string(msg.Body())); err != nil {
+				channel.EnterOutMsg(buildErrorMessage(channel, msg, err))
+			} else {
+				channel.EnterOutMsg(buildReplyMessage(factory, msg, nil))
+			}
+		case consts.CmdUnsubscribe:
+			srv.Unsubscribe(channel, string(msg.Body()))
+			channel.EnterOutMsg(buildReplyMessage(factory, msg, nil))
 		case consts.CmdClose:
 			return
-		default:
-			err = fmt.Errorf("unkunown cmd: %v", msg.Cmd())
-			return
+		default: //CmdPush 和自定义命令
+			if msg.Cmd() != consts.CmdPush {
+				if _, ok := srv.cmdHandler(msg.Cmd()); !ok {
+					err = fmt.Errorf("unkunown cmd: %v", msg.Cmd())
+					reason = CloseProtocolError
+					return
+				}
+			}
+
+			if ac != nil {
+				srv.dispatch(channel, ac, msg, receive)
+			} else {
+				srv.handleRequest(channel, msg, receive)
+			}
 		}
 	}
 }
 
+func (srv *Server) handleRequest(channel *Channel, msg Interface.Message, receive ReceiveInvoker) {
+	data, err := receive(channel, msg)
+	if err != nil {
+		channel.EnterOutMsg(buildErrorMessage(channel, msg, err))
+		return
+	}
+	if data != nil {
+		channel.EnterOutMsg(buildReplyMessage(channel.MsgFactory(), msg, data))
+	}
+}
+
 func (srv *Server) writeLoop(channel *Channel) {
 	var err error
+	reason := CloseUnknown //连接已经关闭
 	defer func() {
 		if err != nil {
 			logger.Printf("%v, writer error: %v", channel, err)
+			reason = CloseWriteError
 		} else {
 			logger.Printf("%v, writer exit", channel)
 		}
-		channel.Close()
+		close(channel.writerDoneC)
+		channel.CloseWithReason(reason)
 	}()
 
-	factory := srv.GetMsgFactory()
+	factory := channel.MsgFactory()
 
 	for {
-		if srv.exiting() {
-			return
+		//回复优先于推送，保证认证回复先于推送到达客户端
+		select {
+		case msg := <-channel.WaitOutMsg():
+			srv.metrics.messageOut(msg.Cmd())
+			_, err = msg.WriteTo(channel.Conn)
+			factory.FreePoolMsg(msg)
+			if err != nil {
+				return
+			}
+			continue
+		default:
 		}
 
 		select {
-		case <-srv.exitC:
-			return
 		case <-channel.Exit():
 			return
+		case closeMsg := <-channel.WaitDrain():
+			err = srv.flush(channel, closeMsg)
+			reason = CloseShutdown
+			return
 		case msg := <-channel.WaitOutMsg():
+			srv.metrics.messageOut(msg.Cmd())
 			_, err = msg.WriteTo(channel.Conn)
 			factory.FreePoolMsg(msg)
 			if err != nil {
 				return
 			}
 		case data := <-channel.WaitOutBytes(): //多播专用chan
-			if _, err = channel.Write(data); err != nil {
+			if err = srv.writeBytes(channel, data); err != nil {
 				return
 			}
 		}
 	}
 }
 
-func (srv *Server) addChannel(channel *Channel, roomId string, channelId string) {
+//写完队列中剩余的消息，最后写入closeMsg
+func (srv *Server) flush(channel *Channel, closeMsg Interface.Message) error {
+	factory := channel.MsgFactory()
+	defer factory.FreePoolMsg(closeMsg)
+
+	for {
+		select {
+		case msg := <-channel.WaitOutMsg():
+			srv.metrics.messageOut(msg.Cmd())
+			_, err := msg.WriteTo(channel.Conn)
+			factory.FreePoolMsg(msg)
+			if err != nil {
+				return err
+			}
+		case data := <-channel.WaitOutBytes():
+			if err := srv.writeBytes(channel, data); err != nil {
+				return err
+			}
+		default:
+			atomic.StoreInt32(&channel.closeSent, 1)
+			srv.metrics.messageOut(closeMsg.Cmd())
+			_, err := closeMsg.WriteTo(channel.Conn)
+			return err
+		}
+	}
+}
+
+func (srv *Server) writeBytes(channel *Channel, data []byte) error {
+	var err error
+	srv.metrics.messageOut(consts.CmdServerPush)
+	if factory := channel.MsgFactory(); factory.WriteEncoded != nil {
+		_, err = factory.WriteEncoded(channel.Conn, data)
+	} else {
+		_, err = channel.Write(data)
+	}
+	return err
+}
+
+//authReply 在加入房间之前入队，保证客户端先收到认证回复
+//LoginPolicy 拒绝时返回错误，authReply 不会被使用
+func (srv *Server) addChannel(channel *Channel, roomId string, channelId string, authReply Interface.Message) error {
 	if channelId == "" {
 		panic("channel_id cannot be empty")
 	}
 	logger.Debugf("new channel, room_id: %v, channel_id: %v", roomId, channelId)
 
-	srv.allChannels.Store(channel, nil)
+	offline, err := srv.join(channel, roomId, channelId, authReply)
+	if err != nil {
+		return err
+	}
+
+	//不持有任何锁，等待慢连接的发送队列不影响同一分段其他房间的登录和推送
+	if len(offline) > 0 {
+		if lastId := srv.replayOffline(channel, roomId, offline); lastId != 0 {
+			//离线消息已交给该连接，不再保留
+			if err := srv.opts.MessageStore.Trim(roomId, lastId); err != nil {
+				logger.Errorf("room:%v trim offline message error: %v", roomId, err)
+			}
+		}
+	}
+
+	//重放上一个连接未确认的推送
+	if srv.reliable != nil {
+		srv.reliable.attach(channel)
+	}
+	return nil
+}
+
+//持有 loginLock 执行登录策略并加入房间，返回需要重放的离线消息
+func (srv *Server) join(channel *Channel, roomId string, channelId string, authReply Interface.Message) ([]StoredMessage, error) {
+	loginLock := srv.loginLocks.get(roomId)
+	loginLock.Lock()
+	defer loginLock.Unlock()
 
 	channel.Init(roomId, channelId)
+	evict, err := srv.evaluateLogin(channel)
+	if err != nil {
+		channel.Init("", "")
+		return nil, err
+	}
+
+	srv.allChannels.Store(channel, nil)
 	channel.OnClose = func() {
 		logger.Debugf("channel onClose")
 
 		// 1.从房间中移除
 		srv.cm.GetOrCreate(roomId).DelIfEqual(channelId, channel)
 		srv.allChannels.Delete(channel)
+		if srv.reliable != nil {
+			srv.reliable.detach(channel)
+		}
+		srv.presenceOffline(channel)
 
 		//2.空房间移除
 		if srv.cm.GetOrCreate(roomId).Size() == 0 {
 			srv.cm.Del(roomId)
+			if srv.cluster != nil {
+				srv.cluster.roomOffline(roomId)
+			}
 		}
 	}
 
-	oldChannel := srv.cm.GetOrCreate(roomId).AddOrReplace(channelId, channel)
+	var oldChannel *Channel
+	var offline []StoredMessage
+	if srv.opts.MessageStore != nil {
+		//取出离线消息和加入房间与 getRoomOrStore 互斥，之后的消息直接推送给该连接
+		lock := srv.storeLock(roomId)
+		lock.Lock()
+		channel.EnterOutMsg(authReply)
+		if offline, err = srv.opts.MessageStore.FetchSince(roomId, 0); err != nil {
+			logger.Errorf("room:%v fetch offline message error: %v", roomId, err)
+		}
+		oldChannel = srv.cm.GetOrCreate(roomId).AddOrReplace(channelId, channel)
+		lock.Unlock()
+	} else {
+		channel.EnterOutMsg(authReply)
+		oldChannel = srv.cm.GetOrCreate(roomId).AddOrReplace(channelId, channel)
+	}
+
+	//旧连接先下线，相同 ChannelId 的是替换，其他是被 LoginPolicy 踢掉
 	if oldChannel != nil {
-		oldChannel.Close()
+		oldChannel.CloseWithReason(CloseReplaced)
+		srv.onReplace(oldChannel, channel)
+	}
+	for _, c := range evict {
+		if c != oldChannel {
+			c.CloseWithReason(CloseEvicted)
+		}
 	}
+	srv.presenceOnline(channel)
+
+	if srv.cluster != nil {
+		srv.cluster.roomOnline(roomId)
+	}
+	return offline, nil
 }
 
 //这里的单播，多播，广播的基本单位是room
 func (srv *Server) Unicast(data []byte, roomId string, filters ...ChannelFilter) {
-	var room *Room
-	var ok bool
+	srv.UnicastContext(context.Background(), data, roomId, filters...)
+}
 
-	if room, ok = srv.cm.Get(roomId); !ok {
-		logger.Debugf("room:%v not exist", roomId)
-		return
+func (srv *Server) Multicast(data []byte, roomIds []string, filters ...ChannelFilter) {
+	srv.MulticastContext(context.Background(), data, roomIds, filters...)
+}
+
+//房间不存在且不在其他节点上时保存为离线消息，与 join 中取出离线消息互斥，保证消息不会丢失
+func (srv *Server) getRoomOrStore(roomId string, data []byte, report *DeliveryReport, remote bool) (*Room, bool) {
+	store := srv.opts.MessageStore
+	if store == nil || remote {
+		return srv.cm.Get(roomId)
 	}
 
-	data = srv.BuildSrvPushMsgBytes(data)
-	room.Broadcast(data, filters...)
+	lock := srv.storeLock(roomId)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	room, ok := srv.cm.Get(roomId)
+	if !ok {
+		if _, err := store.Append(roomId, data); err != nil {
+			logger.Errorf("room:%v store offline message error: %v", roomId, err)
+		} else {
+			report.Stored++
+		}
+	}
+	return room, ok
 }
 
-func (srv *Server) Multicast(data []byte, roomIds []string, filters ...ChannelFilter) {
-	data = srv.BuildSrvPushMsgBytes(data)
+func (srv *Server) storeLock(roomId string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(roomId))
+	return &srv.storeLocks[h.Sum32()%uint32(len(srv.storeLocks))]
+}
+
+//连接加入房间后重放离线消息，不持有 storeLock，重放期间的实时推送可能先到达
+//不使用 OverflowPolicy，第一条没能进入发送队列的消息及之后的消息保留在存储中，返回最后一条进入队列的消息id
+func (srv *Server) replayOffline(channel *Channel, roomId string, messages []StoredMessage) (lastId uint64) {
+	var err error
+	ctx, cancel := context.WithTimeout(context.Background(), offlineReplayTimeout)
+	defer cancel()
+
+	for _, msg := range messages {
+		if srv.reliable != nil {
+			//只加入可靠推送的未确认列表，之后由 attach 重放
+			srv.reliable.add(channel, msg.Data)
+			lastId = msg.Id
+		} else if err = channel.enterOutBytesWait(ctx, newPushEncoder(msg.Data).Bytes(channel.MsgFactory())); err == nil {
+			lastId = msg.Id
+		}
 
-	for _, id := range roomIds {
-		if room, ok := srv.cm.Get(id); ok {
-			room.Broadcast(data, filters...)
+		if err != nil {
+			logger.Errorf("%v, replay offline message error: %v", channel, err)
+			break
 		}
 	}
+	return lastId
 }
 
 func (srv *Server) Broadcast(data []byte, filters ...ChannelFilter) {
-	data = srv.BuildSrvPushMsgBytes(data)
+	srv.BroadcastContext(context.Background(), data, filters...)
+}
 
-	srv.allChannels.Range(func(key, value interface{}) bool {
-		c := key.(*Channel)
-		for _, filter := range filters {
-			if !filter(c) {
-				return true
-			}
-		}
-		c.EnterOutBytes(data)
-		return true
-	})
+func (srv *Server) push(ctx context.Context, channel *Channel, encoder *pushEncoder) error {
+	if srv.reliable != nil {
+		return srv.reliable.push(ctx, channel, encoder.data)
+	}
+	return channel.EnterOutBytesContext(ctx, encoder.Bytes(channel.MsgFactory()))
 }
 
 func (srv *Server) Range(f func(id string, room *Room) bool) {
@@ -343,22 +832,37 @@ func (srv *Server) GetRoom(id string) (*Room, bool) {
 }
 
 func (srv *Server) BuildSrvPushMsgBytes(data []byte) []byte {
-	factory := srv.GetMsgFactory()
+	return buildSrvPushMsgBytes(srv.GetMsgFactory(), data)
+}
 
-	msg := factory.GetPoolMsg().SetBody(data).SetCmd(consts.CmdServerPush)
+func (srv *Server) BuildReplyMessage(srcMsg Interface.Message, data []byte) Interface.Message {
+	return buildReplyMessage(srv.GetMsgFactory(), srcMsg, data)
+}
+
+func (srv *Server) BuildCloseMessage(reason []byte) Interface.Message {
+	return buildCloseMessage(srv.GetMsgFactory(), reason)
+}
+
+func buildSrvPushMsgBytes(factory *protocol.MsgProtoFactory, data []byte) []byte {
+	msg := factory.GetPoolMsg().SetBody(data).SetCmd(consts.CmdServerPush).SetRequestId(0)
 	data = msg.Encode()
 	factory.FreePoolMsg(msg)
 
 	return data
 }
 
-func (srv *Server) BuildReplyMessage(srcMsg Interface.Message, data []byte) Interface.Message {
-	factory := srv.GetMsgFactory()
+func buildReplyMessage(factory *protocol.MsgProtoFactory, srcMsg Interface.Message, data []byte) Interface.Message {
 	msg := factory.GetPoolMsg()
 	msg.SetBody(data).SetCmd(srcMsg.Cmd()).SetRequestId(srcMsg.RequestId())
 	return msg
 }
 
+func buildCloseMessage(factory *protocol.MsgProtoFactory, reason []byte) Interface.Message {
+	msg := factory.GetPoolMsg()
+	msg.SetBody(reason).SetCmd(consts.CmdClose).SetRequestId(0)
+	return msg
+}
+
 func (srv *Server) GetMsgFactory() *protocol.MsgProtoFactory {
 	return srv.opts.MsgFactory
 }
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/kuhufu/cm/client"
+	"github.com/kuhufu/cm/protocol"
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type echoHandler struct{}
+
+//data格式 room[:channel]，channel默认为web
+func (h echoHandler) OnAuth(data []byte) *AuthReply {
+	ids := strings.SplitN(string(data), ":", 2)
+	if len(ids) == 1 {
+		ids = append(ids, "web")
+	}
+
+	return &AuthReply{
+		Ok:        true,
+		RoomId:    ids[0],
+		ChannelId: ids[1],
+		Data:      []byte("hello"),
+	}
+}
+
+func (h echoHandler) OnReceive(channel *Channel, data []byte) (resp []byte) {
+	return data
+}
+
+func (h echoHandler) OnClose(channel *Channel) {}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func waitListen(host string) {
+	for i := 0; i < 100; i++ {
+		conn, err := net.Dial("tcp", host)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+//启动服务端，监听后返回，默认使用 echoHandler 和 BINARY 协议，opts 可以覆盖
+func runServer(t *testing.T, scheme string, opts ...Option) (*Server, string) {
+	host := freeAddr(t)
+	addr := fmt.Sprintf("%v://%v", scheme, host)
+	if scheme == "ws" || scheme == "wss" {
+		addr += "/ws"
+	}
+
+	srv := NewServer(append([]Option{WithHandler(echoHandler{}), WithMsgProtocol(protocol.BINARY)}, opts...)...)
+	go srv.Run(addr)
+	waitListen(host)
+
+	return srv, addr
+}
+
+//连接失败时结束测试
+func dial(t *testing.T, addr string, authData string, opts ...client.Option) *client.Client {
+	t.Helper()
+	c, err := client.Dial(addr, []byte(authData), opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+//等待推送，超时时结束测试
+func expectPush(t *testing.T, push <-chan []byte, want string) {
+	t.Helper()
+	select {
+	case data := <-push:
+		if string(data) != want {
+			t.Errorf("got %s, want %s", data, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("%v timeout", want)
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	srv, addr := runServer(t, "ws")
+
+	c := dial(t, addr, "3")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-c.Exit():
+		if c.Err() != client.ErrClosed {
+			t.Errorf("want close message, got: %v", c.Err())
+		}
+	case <-time.After(time.Second):
+		t.Error("client not closed")
+	}
+
+	u, _ := url.Parse(addr)
+	if _, err := net.Dial("tcp", u.Host); err == nil {
+		t.Error("listener not closed")
+	}
+}
+
+func TestServer_RunAll(t *testing.T) {
+	tcpHost, wsHost, ws2Host := freeAddr(t), freeAddr(t), freeAddr(t)
+	tcpAddr := fmt.Sprintf("tcp://%v", tcpHost)
+	wsAddr := fmt.Sprintf("ws://%v/ws", wsHost)
+	ws2Addr := fmt.Sprintf("ws://%v/ws", ws2Host) //不同端口使用相同的path
+
+	srv := NewServer(WithHandler(echoHandler{}))
+	defer srv.Close()
+
+	go srv.RunAll(
+		Endpoint{Addr: tcpAddr, Opts: []Option{WithMsgProtocol(protocol.BINARY)}},
+		Endpoint{Addr: wsAddr, Opts: []Option{WithMsgProtocol(protocol.JSON)}},
+		Endpoint{Addr: ws2Addr, Opts: []Option{WithMsgProtocol(protocol.PROTOBUF)}},
+	)
+	waitListen(tcpHost)
+	waitListen(wsHost)
+	waitListen(ws2Host)
+
+	tcpClient := dial(t, tcpAddr, "4:ios", client.WithMsgProtocol(protocol.BINARY))
+	defer tcpClient.Close()
+
+	wsClient := dial(t, wsAddr, "4:web", client.WithMsgProtocol(protocol.JSON))
+	defer wsClient.Close()
+
+	ws2Client := dial(t, ws2Addr, "4:app", client.WithMsgProtocol(protocol.PROTOBUF))
+	defer ws2Client.Close()
+
+	//每个端口只处理自己的path
+	if _, err := client.Dial(fmt.Sprintf("ws://%v/other", wsHost), []byte("4:other")); err == nil {
+		t.Error("path of other endpoint should not be served")
+	}
+
+	srv.Unicast([]byte("push"), "4")
+
+	for _, c := range []*client.Client{tcpClient, wsClient, ws2Client} {
+		expectPush(t, c.Push(), "push")
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+//离线消息
+type StoredMessage struct {
+	Id   uint64 //房间内递增，从1开始
+	Data []byte
+	Time time.Time
+}
+
+//离线消息存储，Unicast/Multicast 的目标房间不存在时保存消息，房间内有连接认证成功后重放
+type MessageStore interface {
+	//保存消息，返回消息id
+	Append(roomId string, data []byte) (uint64, error)
+	//获取id大于since且未过期的消息，按id升序
+	FetchSince(roomId string, since uint64) ([]StoredMessage, error)
+	//删除id小于等于upTo的消息
+	Trim(roomId string, upTo uint64) error
+}
+
+//重放离线消息的最长时间，超时后剩余的消息留到下次认证时重放
+const offlineReplayTimeout = time.Second * 10
+
+type roomMessages struct {
+	lastId   uint64
+	messages []StoredMessage
+}
+
+//内存存储，ttl<=0 表示不过期
+//有消息时每隔ttl删除一次过期的消息和空房间，房间删除后该房间的id重新从1开始
+type MemoryStore struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	rooms      map[string]*roomMessages
+	sweepTimer *time.Timer //没有消息时为nil
+}
+
+func NewMemoryStore(ttl time.Duration) *MemoryStore {
+	return &MemoryStore{
+		ttl:   ttl,
+		rooms: map[string]*roomMessages{},
+	}
+}
+
+func (s *MemoryStore) Append(roomId string, data []byte) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, ok := s.rooms[roomId]
+	if !ok {
+		room = &roomMessages{}
+		s.rooms[roomId] = room
+	}
+
+	room.lastId++
+	room.messages = append(expire(room.messages, s.ttl), StoredMessage{
+		Id:   room.lastId,
+		Data: append([]byte(nil), data...), //调用者可能复用data
+		Time: time.Now(),
+	})
+
+	if s.ttl > 0 && s.sweepTimer == nil {
+		s.sweepTimer = time.AfterFunc(s.ttl, s.sweep)
+	}
+	return room.lastId, nil
+}
+
+//删除过期的消息和空房间，还有消息时继续定时
+func (s *MemoryStore) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for roomId, room := range s.rooms {
+		room.messages = expire(room.messages, s.ttl)
+		if len(room.messages) == 0 {
+			delete(s.rooms, roomId)
+		}
+	}
+
+	if len(s.rooms) > 0 {
+		s.sweepTimer.Reset(s.ttl)
+	} else {
+		s.sweepTimer = nil
+	}
+}
+
+func (s *MemoryStore) FetchSince(roomId string, since uint64) ([]StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, ok := s.rooms[roomId]
+	if !ok {
+		return nil, nil
+	}
+
+	room.messages = expire(room.messages, s.ttl)
+
+	var list []StoredMessage
+	for _, msg := range room.messages {
+		if msg.Id > since {
+			list = append(list, msg)
+		}
+	}
+	return list, nil
+}
+
+func (s *MemoryStore) Trim(roomId string, upTo uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, ok := s.rooms[roomId]
+	if !ok {
+		return nil
+	}
+
+	i := 0
+	for i < len(room.messages) && room.messages[i].Id <= upTo {
+		i++
+	}
+	//保留 lastId 直到定时清理，避免重连前后id重复
+	room.messages = room.messages[i:]
+	return nil
+}
+
+//去掉过期的消息，messages 按时间升序
+func expire(messages []StoredMessage, ttl time.Duration) []StoredMessage {
+	if ttl <= 0 {
+		return messages
+	}
+
+	deadline := time.Now().Add(-ttl)
+	i := 0
+	for i < len(messages) && messages[i].Time.Before(deadline) {
+		i++
+	}
+	return messages[i:]
+}
@@ -0,0 +1,243 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	logger "github.com/kuhufu/cm/logger"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//记录格式: id uint64 | time int64(UnixNano) | dataLen uint32 | data
+const fileRecordHeaderLen = 20
+
+//文件存储，每个房间一个文件，ttl<=0 表示不过期
+//有消息时每隔ttl删除一次过期的消息，包括目录中已有的文件
+//房间消息全部删除后文件也会删除，定时清理之后或进程重启后该房间的id重新从1开始
+type FileStore struct {
+	mu         sync.Mutex
+	dir        string
+	ttl        time.Duration
+	lastIds    map[string]uint64
+	sweepTimer *time.Timer //没有文件时为nil
+}
+
+func NewFileStore(dir string, ttl time.Duration) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &FileStore{
+		dir:     dir,
+		ttl:     ttl,
+		lastIds: map[string]uint64{},
+	}
+	if ttl > 0 {
+		s.sweepTimer = time.AfterFunc(ttl, s.sweep)
+	}
+	return s, nil
+}
+
+func (s *FileStore) path(roomId string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(roomId))+".msg")
+}
+
+func (s *FileStore) Append(roomId string, data []byte) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	lastId, ok := s.lastIds[roomId]
+	if !ok {
+		messages, err := s.read(roomId)
+		if err != nil {
+			return 0, err
+		}
+		if len(messages) > 0 {
+			lastId = messages[len(messages)-1].Id
+		}
+	}
+
+	f, err := os.OpenFile(s.path(roomId), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	msg := StoredMessage{
+		Id:   lastId + 1,
+		Data: data,
+		Time: time.Now(),
+	}
+	if _, err := f.Write(encodeRecord(msg)); err != nil {
+		return 0, err
+	}
+
+	s.lastIds[roomId] = msg.Id
+	if s.ttl > 0 && s.sweepTimer == nil {
+		s.sweepTimer = time.AfterFunc(s.ttl, s.sweep)
+	}
+	return msg.Id, nil
+}
+
+//删除过期的消息和空文件，还有文件时继续定时
+func (s *FileStore) sweep() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.msg"))
+	if err != nil {
+		logger.Errorf("sweep offline message error: %v", err)
+	}
+
+	left := 0
+	for _, path := range paths {
+		roomId, err := hex.DecodeString(strings.TrimSuffix(filepath.Base(path), ".msg"))
+		if err != nil { //不是 FileStore 的文件
+			continue
+		}
+		if err := s.trim(string(roomId), 0); err != nil {
+			logger.Errorf("room:%s sweep offline message error: %v", roomId, err)
+		}
+		if _, err := os.Stat(path); err == nil {
+			left++
+		}
+	}
+
+	//文件已删除的房间
+	for roomId := range s.lastIds {
+		if _, err := os.Stat(s.path(roomId)); os.IsNotExist(err) {
+			delete(s.lastIds, roomId)
+		}
+	}
+
+	if left > 0 {
+		s.sweepTimer.Reset(s.ttl)
+	} else {
+		s.sweepTimer = nil
+	}
+}
+
+func (s *FileStore) FetchSince(roomId string, since uint64) ([]StoredMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages, err := s.read(roomId)
+	if err != nil {
+		return nil, err
+	}
+
+	messages = expire(messages, s.ttl)
+
+	var list []StoredMessage
+	for _, msg := range messages {
+		if msg.Id > since {
+			list = append(list, msg)
+		}
+	}
+	return list, nil
+}
+
+func (s *FileStore) Trim(roomId string, upTo uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.trim(roomId, upTo)
+}
+
+//删除过期的消息和id小于等于upTo的消息
+func (s *FileStore) trim(roomId string, upTo uint64) error {
+	messages, err := s.read(roomId)
+	if err != nil {
+		return err
+	}
+
+	var left []StoredMessage
+	for _, msg := range expire(messages, s.ttl) {
+		if msg.Id > upTo {
+			left = append(left, msg)
+		}
+	}
+
+	path := s.path(roomId)
+	if len(left) == 0 {
+		err = os.Remove(path)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	//先写临时文件再替换，避免写到一半丢失数据
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(f)
+	for _, msg := range left {
+		w.Write(encodeRecord(msg))
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+//文件不存在时返回空，末尾不完整的记录会被忽略
+func (s *FileStore) read(roomId string) ([]StoredMessage, error) {
+	f, err := os.Open(s.path(roomId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	header := make([]byte, fileRecordHeaderLen)
+
+	var messages []StoredMessage
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return messages, nil
+			}
+			return nil, err
+		}
+
+		data := make([]byte, binary.BigEndian.Uint32(header[16:20]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return messages, nil
+			}
+			return nil, err
+		}
+
+		messages = append(messages, StoredMessage{
+			Id:   binary.BigEndian.Uint64(header[0:8]),
+			Time: time.Unix(0, int64(binary.BigEndian.Uint64(header[8:16]))),
+			Data: data,
+		})
+	}
+}
+
+func encodeRecord(msg StoredMessage) []byte {
+	record := make([]byte, fileRecordHeaderLen+len(msg.Data))
+	binary.BigEndian.PutUint64(record[0:8], msg.Id)
+	binary.BigEndian.PutUint64(record[8:16], uint64(msg.Time.UnixNano()))
+	binary.BigEndian.PutUint32(record[16:20], uint32(len(msg.Data)))
+	copy(record[fileRecordHeaderLen:], msg.Data)
+	return record
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"fmt"
+	"github.com/kuhufu/cm/protocol"
+	"github.com/kuhufu/cm/protocol/consts"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testMessageStore(t *testing.T, store MessageStore) {
+	for _, data := range []string{"a", "b", "c"} {
+		if _, err := store.Append("1", []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	messages, err := store.FetchSince("1", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(messages) != 2 || string(messages[0].Data) != "b" || messages[1].Id != 3 {
+		t.Errorf("wrong messages: %v", messages)
+	}
+
+	if err := store.Trim("1", 2); err != nil {
+		t.Fatal(err)
+	}
+	messages, _ = store.FetchSince("1", 0)
+	if len(messages) != 1 || string(messages[0].Data) != "c" {
+		t.Errorf("wrong messages after trim: %v", messages)
+	}
+
+	//删除后id继续递增
+	store.Trim("1", 3)
+	if id, _ := store.Append("1", []byte("d")); id != 4 {
+		t.Errorf("wrong id: %v", id)
+	}
+
+	if messages, _ := store.FetchSince("2", 0); len(messages) != 0 {
+		t.Errorf("room 2 should be empty: %v", messages)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testMessageStore(t, NewMemoryStore(0))
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cm-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileStore(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testMessageStore(t, store)
+}
+
+func TestMemoryStore_TTL(t *testing.T) {
+	store := NewMemoryStore(time.Millisecond * 10)
+	store.Append("1", []byte("a"))
+	time.Sleep(time.Millisecond * 20)
+	store.Append("1", []byte("b"))
+
+	messages, _ := store.FetchSince("1", 0)
+	if len(messages) != 1 || string(messages[0].Data) != "b" {
+		t.Errorf("wrong messages: %v", messages)
+	}
+}
+
+func TestOfflineMessage_Overflow(t *testing.T) {
+	store := NewMemoryStore(time.Minute)
+	srv, addr := runServer(t, "tcp", WithMessageStore(store), WithOverflowPolicy(OverflowDropNewest, 0))
+	defer srv.Close()
+
+	//比发送队列长，重放不受 OverflowPolicy 影响
+	const n = 20
+	for i := 0; i < n; i++ {
+		srv.Unicast([]byte(fmt.Sprint(i)), "23")
+	}
+
+	c := dial(t, addr, "23")
+	defer c.Close()
+
+	for i := 0; i < n; i++ {
+		expectPush(t, c.Push(), fmt.Sprint(i))
+	}
+	if messages, _ := store.FetchSince("23", 0); len(messages) != 0 {
+		t.Errorf("replayed messages not trimmed: %v", len(messages))
+	}
+}
+
+func TestOfflineMessage(t *testing.T) {
+	store := NewMemoryStore(time.Minute)
+	srv, addr := runServer(t, "tcp", WithMessageStore(store))
+	defer srv.Close()
+
+	srv.Unicast([]byte("offline1"), "6")
+	srv.Multicast([]byte("offline2"), []string{"6"})
+
+	c := dial(t, addr, "6")
+	defer c.Close()
+
+	//重放在加入房间之后，等重放完成再发送实时推送
+	waitTrimmed(t, store, "6")
+	srv.Unicast([]byte("online"), "6")
+
+	for _, want := range []string{"offline1", "offline2", "online"} {
+		expectPush(t, c.Push(), want)
+	}
+}
+
+//慢连接重放离线消息时不阻塞同一房间的推送
+func TestOfflineMessage_SlowReplay(t *testing.T) {
+	srv, addr := runServer(t, "tcp", WithMessageStore(NewMemoryStore(time.Minute)), WithOverflowPolicy(OverflowDropNewest, 0))
+	defer srv.Close()
+
+	//超过socket缓冲区，不读取的连接会让重放一直等待
+	data := make([]byte, 256*1024)
+	for i := 0; i < 64; i++ {
+		srv.Unicast(data, "25")
+	}
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(addr, "tcp://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	msg := protocol.GetFactory(protocol.BINARY).NewDefaultMessage().SetCmd(consts.CmdAuth).SetRequestId(1).SetBody([]byte("25"))
+	if _, err := msg.WriteTo(conn); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := msg.ReadFrom(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		srv.Unicast([]byte("online"), "25")
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("push blocked by offline replay")
+	}
+}
+
+func waitTrimmed(t *testing.T, store MessageStore, roomId string) {
+	deadline := time.Now().Add(time.Second)
+	for {
+		messages, err := store.FetchSince(roomId, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(messages) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("offline messages not replayed: %v", len(messages))
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestMemoryStore_Sweep(t *testing.T) {
+	store := NewMemoryStore(time.Millisecond * 10)
+	data := []byte("a")
+	store.Append("1", data)
+	data[0] = 'b' //Append 复制了data
+
+	messages, _ := store.FetchSince("1", 0)
+	if len(messages) != 1 || string(messages[0].Data) != "a" {
+		t.Errorf("wrong messages: %v", messages)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+
+	store.mu.Lock()
+	rooms, timer := len(store.rooms), store.sweepTimer
+	store.mu.Unlock()
+	if rooms != 0 || timer != nil {
+		t.Errorf("expired room not swept: %v", rooms)
+	}
+}
+
+func TestFileStore_Sweep(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cm-store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := NewFileStore(dir, time.Millisecond*10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Append("1", []byte("a"))
+
+	time.Sleep(time.Millisecond * 50)
+
+	if _, err := os.Stat(store.path("1")); !os.IsNotExist(err) {
+		t.Errorf("expired file not removed: %v", err)
+	}
+	store.mu.Lock()
+	lastIds := len(store.lastIds)
+	store.mu.Unlock()
+	if lastIds != 0 {
+		t.Errorf("lastIds not cleared: %v", lastIds)
+	}
+}
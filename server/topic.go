@@ -0,0 +1,168 @@
+package server
+
+import (
+	"context"
+	"github.com/kuhufu/cm/cluster"
+	"sync"
+)
+
+//主题，与房间无关，一个连接可以订阅多个主题
+type Topic struct {
+	Name    string
+	mu      sync.RWMutex
+	members map[*Channel]struct{}
+}
+
+func (t *Topic) Size() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.members)
+}
+
+func (t *Topic) Range(f func(channel *Channel) bool) {
+	t.mu.RLock()
+	channels := make([]*Channel, 0, len(t.members))
+	for channel := range t.members {
+		channels = append(channels, channel)
+	}
+	t.mu.RUnlock()
+
+	for _, channel := range channels {
+		if !f(channel) {
+			return
+		}
+	}
+}
+
+//没有订阅者的主题会被删除
+type topicManager struct {
+	mu     sync.RWMutex
+	topics map[string]*Topic
+}
+
+func newTopicManager() *topicManager {
+	return &topicManager{
+		topics: map[string]*Topic{},
+	}
+}
+
+func (m *topicManager) get(name string) (*Topic, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	t, ok := m.topics[name]
+	return t, ok
+}
+
+func (m *topicManager) add(name string, channel *Channel) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.topics[name]
+	if !ok {
+		t = &Topic{Name: name, members: map[*Channel]struct{}{}}
+		m.topics[name] = t
+	}
+
+	t.mu.Lock()
+	t.members[channel] = struct{}{}
+	t.mu.Unlock()
+}
+
+func (m *topicManager) del(name string, channel *Channel) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.topics[name]
+	if !ok {
+		return
+	}
+
+	t.mu.Lock()
+	delete(t.members, channel)
+	empty := len(t.members) == 0
+	t.mu.Unlock()
+
+	if empty {
+		delete(m.topics, name)
+	}
+}
+
+//连接订阅主题，重复订阅无影响
+func (srv *Server) Subscribe(channel *Channel, topic string) error {
+	if topic == "" {
+		return ErrInvalidTopic
+	}
+	if !channel.Alive() {
+		return ErrChannelClosed
+	}
+
+	channel.addTopic(topic)
+	srv.topics.add(topic, channel)
+
+	//订阅过程中连接关闭，unsubscribeAll 可能没有看到这个主题
+	if !channel.Alive() {
+		srv.Unsubscribe(channel, topic)
+		return ErrChannelClosed
+	}
+	return nil
+}
+
+//客户端发起的订阅需要 SubscribeHandler 授权
+func (srv *Server) clientSubscribe(channel *Channel, topic string) error {
+	if topic == "" {
+		return ErrInvalidTopic
+	}
+
+	if h, ok := channel.opts.Handler.(SubscribeHandler); ok {
+		if err := h.OnSubscribe(channel, topic); err != nil {
+			return err
+		}
+	}
+	return srv.Subscribe(channel, topic)
+}
+
+func (srv *Server) Unsubscribe(channel *Channel, topic string) {
+	channel.delTopic(topic)
+	srv.topics.del(topic, channel)
+}
+
+//连接关闭时取消所有订阅
+func (srv *Server) unsubscribeAll(channel *Channel) {
+	for _, topic := range channel.Topics() {
+		srv.Unsubscribe(channel, topic)
+	}
+}
+
+func (srv *Server) GetTopic(name string) (*Topic, bool) {
+	return srv.topics.get(name)
+}
+
+//推送给订阅了主题的所有连接
+func (srv *Server) Publish(topic string, data []byte, filters ...ChannelFilter) {
+	srv.PublishContext(context.Background(), topic, data, filters...)
+}
+
+//集群模式下同时转发给其他节点，filters 只作用于本节点的连接
+func (srv *Server) PublishContext(ctx context.Context, topic string, data []byte, filters ...ChannelFilter) DeliveryReport {
+	return srv.publish(ctx, topic, data, true, filters...)
+}
+
+func (srv *Server) publish(ctx context.Context, topic string, data []byte, forward bool, filters ...ChannelFilter) DeliveryReport {
+	var report DeliveryReport
+
+	if forward && srv.cluster != nil {
+		srv.cluster.publish(&cluster.Message{Type: cluster.MsgPublish, Topic: topic, Data: data})
+	}
+
+	t, ok := srv.topics.get(topic)
+	if !ok {
+		return report
+	}
+
+	encoder := newPushEncoder(data)
+	t.Range(func(channel *Channel) bool {
+		srv.deliver(ctx, channel, encoder, &report, filters...)
+		return true
+	})
+	return report
+}
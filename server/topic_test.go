@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/kuhufu/cm/client"
+	"github.com/kuhufu/cm/protocol"
+	"github.com/kuhufu/cm/protocol/consts"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServer_Publish(t *testing.T) {
+	srv := NewServer(WithMsgProtocol(protocol.BINARY))
+
+	conn, _ := net.Pipe()
+	a := NewChannel(conn, "pipe", srv)
+	b := NewChannel(conn, "pipe", srv)
+
+	srv.Subscribe(a, "score")
+	srv.Subscribe(b, "score")
+	srv.Subscribe(b, "stock")
+
+	if err := srv.Subscribe(a, ""); err != ErrInvalidTopic {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	if report := srv.PublishContext(context.Background(), "score", []byte("1:0")); report.Enqueued != 2 {
+		t.Errorf("wrong report: %+v", report)
+	}
+	if report := srv.PublishContext(context.Background(), "stock", []byte("up")); report.Enqueued != 1 {
+		t.Errorf("wrong report: %+v", report)
+	}
+
+	srv.Unsubscribe(b, "score")
+	if topic, _ := srv.GetTopic("score"); topic.Size() != 1 {
+		t.Errorf("wrong size: %v", topic.Size())
+	}
+
+	//连接关闭后取消所有订阅，空主题被删除
+	b.Close()
+	srv.unsubscribeAll(b)
+	if _, ok := srv.GetTopic("stock"); ok {
+		t.Error("topic stock should be removed")
+	}
+	if err := srv.Subscribe(b, "stock"); err != ErrChannelClosed {
+		t.Errorf("wrong error: %v", err)
+	}
+	if len(b.Topics()) != 0 {
+		t.Errorf("wrong topics: %v", b.Topics())
+	}
+}
+
+//只允许订阅 public/ 开头的主题和自己房间的主题
+type subscribeHandler struct {
+	echoHandler
+}
+
+func (h subscribeHandler) OnSubscribe(channel *Channel, topic string) error {
+	if strings.HasPrefix(topic, "public/") || strings.HasPrefix(topic, channel.RoomId()+"/") {
+		return nil
+	}
+	return NewError(consts.CodeForbidden, "forbidden")
+}
+
+func TestTopic(t *testing.T) {
+	srv, addr := runServer(t, "tcp")
+	defer srv.Close()
+
+	ctx := context.Background()
+
+	c1 := dial(t, addr, "8")
+	defer c1.Close()
+
+	c2, err := client.DialReconnect(addr, []byte("9"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	for _, topic := range []string{"score"} {
+		if err := c1.Subscribe(ctx, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, topic := range []string{"score", "stock"} {
+		if err := c2.Subscribe(ctx, topic); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var e *Error
+	if err := c1.Subscribe(ctx, ""); !errors.As(err, &e) || e.Code != consts.CodeBadRequest {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	srv.Publish("score", []byte("1:0"))
+	expectPush(t, c1.Push(), "1:0")
+	expectPush(t, c2.Push(), "1:0")
+
+	srv.Publish("stock", []byte("up"))
+	expectPush(t, c2.Push(), "up")
+
+	if err := c1.Unsubscribe(ctx, "score"); err != nil {
+		t.Fatal(err)
+	}
+	if topic, _ := srv.GetTopic("score"); topic.Size() != 1 {
+		t.Errorf("wrong size: %v", topic.Size())
+	}
+
+	//服务端订阅
+	room, _ := srv.GetRoom("8")
+	channel, _ := room.Get("web")
+	if err := srv.Subscribe(channel, "news"); err != nil {
+		t.Fatal(err)
+	}
+	srv.Publish("news", []byte("hi"))
+	expectPush(t, c1.Push(), "hi")
+
+	//重连后重新订阅，重新订阅完成后 Client 才返回新连接
+	old := c2.Client()
+	room, _ = srv.GetRoom("9")
+	channel, _ = room.Get("web")
+	channel.Close()
+	deadline := time.Now().Add(time.Second * 3)
+	for c := c2.Client(); c == nil || c == old; c = c2.Client() {
+		if time.Now().After(deadline) {
+			t.Fatal("not reconnected")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	srv.Publish("stock", []byte("down"))
+	expectPush(t, c2.Push(), "down")
+}
+
+func TestSubscribeHandler(t *testing.T) {
+	srv, addr := runServer(t, "tcp", WithHandler(subscribeHandler{}))
+	defer srv.Close()
+
+	c := dial(t, addr, "10")
+	defer c.Close()
+
+	ctx := context.Background()
+	for _, topic := range []string{"public/news", "10/chat"} {
+		if err := c.Subscribe(ctx, topic); err != nil {
+			t.Errorf("%v: %v", topic, err)
+		}
+	}
+
+	var e *Error
+	err := c.Subscribe(ctx, "11/chat")
+	if !errors.As(err, &e) || e.Code != consts.CodeForbidden || e.Message != "forbidden" {
+		t.Errorf("wrong error: %v", err)
+	}
+	if _, ok := srv.GetTopic("11/chat"); ok {
+		t.Error("topic 11/chat should not exist")
+	}
+}
@@ -6,5 +6,6 @@ type AuthReply struct {
 	ChannelId string //不能为空，否则panic
 	Data      []byte
 	Metadata  map[interface{}]interface{}
-	err       error
+	//不为nil时认证失败，以该错误回复，*Error 时使用其状态码，连接可以继续认证
+	Err error
 }
@@ -40,33 +40,25 @@ func (h Handler) OnClose(conn *server.Channel) {
 }
 
 func Test_Server(t *testing.T) {
-	binarySrv := server.NewServer(
+	srv := server.NewServer(
 		server.WithHandler(&Handler{}),
 		server.WithAuthTimeout(time.Second*1000),
 		server.WithHeartbeatTimeout(time.Second*300),
 		server.WithDebugLog(),
 		server.WithCertAndKeyFile("cert/cert.pem", "cert/key.pem"),
-		server.WithMsgProtocol(protocol.BINARY),
 	)
 
 	go func() {
-		err := binarySrv.Run("tcp://0.0.0.0:8080")
-		if err != nil {
-			t.Error(err)
-		}
-	}()
-
-	jsonSrv := server.NewServer(
-		server.WithHandler(&Handler{}),
-		server.WithAuthTimeout(time.Second*1000),
-		server.WithHeartbeatTimeout(time.Second*300),
-		server.WithDebugLog(),
-		server.WithCertAndKeyFile("cert/cert.pem", "cert/key.pem"),
-		server.WithMsgProtocol(protocol.JSON),
-	)
-
-	go func() {
-		err := jsonSrv.Run("wss://0.0.0.0:8081/ws")
+		err := srv.RunAll(
+			server.Endpoint{
+				Addr: "tcp://0.0.0.0:8080",
+				Opts: []server.Option{server.WithMsgProtocol(protocol.BINARY)},
+			},
+			server.Endpoint{
+				Addr: "wss://0.0.0.0:8081/ws",
+				Opts: []server.Option{server.WithMsgProtocol(protocol.JSON)},
+			},
+		)
 		if err != nil {
 			t.Error(err)
 		}
@@ -77,11 +69,7 @@ func Test_Server(t *testing.T) {
 			time.Sleep(time.Second)
 			bytes := []byte("hello world")
 
-			binarySrv.Broadcast(bytes, func(channel *server.Channel) bool {
-				return channel.Id() == "web"
-			})
-
-			jsonSrv.Broadcast(bytes, func(channel *server.Channel) bool {
+			srv.Broadcast(bytes, func(channel *server.Channel) bool {
 				return channel.Id() == "web"
 			})
 		}
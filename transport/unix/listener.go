@@ -0,0 +1,82 @@
+package unix
+
+import (
+	"errors"
+	"github.com/kuhufu/cm/transport/tcp"
+	"net"
+	"os"
+	"time"
+)
+
+var ErrAddrInUse = errors.New("unix socket in use")
+
+//和tcp使用相同的消息帧，连接为 *tcp.Conn
+type Listener struct {
+	opts Options
+	net.Listener
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &tcp.Conn{
+		Conn:         conn,
+		ReadTimeout:  l.opts.ReadTimeout,
+		WriteTimeout: l.opts.WriteTimeout,
+	}, nil
+}
+
+//path 以@开头时为 linux 的抽象socket，不会创建文件
+//Close 时删除socket文件
+func Listen(path string, opts Options) (net.Listener, error) {
+	abstract := len(path) > 0 && path[0] == '@'
+	if !abstract {
+		if err := removeStale(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.FileMode != 0 && !abstract {
+		if err := os.Chmod(path, opts.FileMode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	return &Listener{
+		Listener: ln,
+		opts:     opts,
+	}, nil
+}
+
+//进程异常退出时socket文件不会被删除，连接不上的socket文件视为残留
+//不是socket的文件不删除
+func removeStale(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return errors.New("not a unix socket: " + path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return ErrAddrInUse
+	}
+
+	return os.Remove(path)
+}
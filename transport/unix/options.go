@@ -0,0 +1,13 @@
+package unix
+
+import (
+	"os"
+	"time"
+)
+
+type Options struct {
+	//socket文件的权限，0表示不修改，由umask决定
+	FileMode     os.FileMode
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
@@ -33,6 +33,7 @@ type Listener struct {
 	connC     chan net.Conn
 	closeOnce sync.Once
 	addr      net.Addr
+	server    *http.Server
 }
 
 func Listen(network, addr string, opts Options) (*Listener, error) {
@@ -62,12 +63,17 @@ func Listen(network, addr string, opts Options) (*Listener, error) {
 			network: network,
 			addr:    addr,
 		},
+		server: &http.Server{
+			Addr:    addr,
+			Handler: opts.ServeMux,
+		},
 		upgrader: websocket.Upgrader{
 			CheckOrigin: func(r *http.Request) bool {
 				return true
 			},
 		},
 	}
+	opts.ServeMux.HandleFunc(path, ln.upgrade)
 	go ln.runUpgrader()
 	return ln, nil
 }
@@ -84,41 +90,47 @@ func (w *Listener) Accept() (net.Conn, error) {
 func (w *Listener) runUpgrader() {
 	opts := w.opts
 
-	opts.ServeMux.HandleFunc(w.path, func(writer http.ResponseWriter, reader *http.Request) {
-		log.Println("收到ws升级请求")
-		conn, err := w.upgrader.Upgrade(writer, reader, nil)
-		if err != nil {
-			log.Error("ws升级失败:", err)
-			writer.Write([]byte(err.Error()))
-			return
-		}
-		w.connC <- &Conn{
-			Conn:         conn,
-			ReadTimeout:  w.opts.ReadTimeout,
-			WriteTimeout: w.opts.WriteTimeout,
-		}
-	})
-
 	var err error
 	switch w.scheme {
 	case "ws":
 		log.Printf("http://%v%v", w.host, w.path)
-		err = http.ListenAndServe(w.host, nil)
+		err = w.server.ListenAndServe()
 	case "wss":
 		log.Printf("https://%v%v", w.host, w.path)
-		err = http.ListenAndServeTLS(w.host, opts.CertFile, opts.KeyFile, nil)
+		err = w.server.ListenAndServeTLS(opts.CertFile, opts.KeyFile)
 	}
 
-	if err != nil {
+	if err != nil && err != http.ErrServerClosed {
 		log.Println(err)
 	}
 }
 
+func (w *Listener) upgrade(writer http.ResponseWriter, reader *http.Request) {
+	log.Println("收到ws升级请求")
+	conn, err := w.upgrader.Upgrade(writer, reader, nil)
+	if err != nil {
+		log.Error("ws升级失败:", err)
+		writer.Write([]byte(err.Error()))
+		return
+	}
+	select {
+	case <-w.exitC:
+		conn.Close()
+	case w.connC <- &Conn{
+		Conn:         conn,
+		ReadTimeout:  w.opts.ReadTimeout,
+		WriteTimeout: w.opts.WriteTimeout,
+	}:
+	}
+}
+
 func (w *Listener) Close() error {
+	var err error
 	w.closeOnce.Do(func() {
 		close(w.exitC)
+		err = w.server.Close()
 	})
-	return nil
+	return err
 }
 
 func (w *Listener) Addr() net.Addr {
@@ -16,6 +16,7 @@ type Options struct {
 	WriteTimeout time.Duration
 }
 
+//ServeMux 为nil时使用 http.DefaultServeMux，同一个 ServeMux 上path不能重复
 func (opts *Options) Init() error {
 	if opts.ServeMux == nil {
 		opts.ServeMux = http.DefaultServeMux